@@ -0,0 +1,332 @@
+package ircb
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// whoxToken marks our WHOX queries, 'WHO nick %tna,616'
+const whoxToken = "616"
+
+// how long an account is trusted without account-notify, and how long to wait for verification
+const (
+	accountTTL    = 5 * time.Minute
+	verifyTimeout = 30 * time.Second
+)
+
+// accounts tracks the services accounts of nicks, from account-tag, account-notify (ACCOUNT),
+// extended-join, WHOX (354) and WHOIS (330) replies.
+type accounts struct {
+	lock     sync.Mutex
+	byNick   map[string]account   // by folded nick
+	asked    map[string]time.Time // WHO or WHOIS sent, by folded nick
+	nickserv time.Time            // MasterCheck sent
+	pending  map[string][]*pending
+}
+
+type account struct {
+	name  string // empty for not logged in
+	seen  time.Time
+	guess bool // not from the server, only no account in a WHO or WHOIS reply, see serverAccount
+}
+
+// pending is a command waiting for its sender to be verified
+type pending struct {
+	irc  *IRC
+	role Role
+	run  func()
+}
+
+func newAccounts() *accounts {
+	return &accounts{
+		byNick:  make(map[string]account),
+		asked:   make(map[string]time.Time),
+		pending: make(map[string][]*pending),
+	}
+}
+
+// reset forgets everything, before connecting
+func (a *accounts) reset() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.byNick = make(map[string]account)
+	a.asked = make(map[string]time.Time)
+	a.nickserv = time.Time{}
+	a.pending = make(map[string][]*pending)
+}
+
+// setAccount for nick, name can be empty for not logged in
+func (c *Connection) setAccount(nick, name string) {
+	if name == "*" || name == "0" {
+		name = ""
+	}
+	c.accounts.lock.Lock()
+	c.accounts.byNick[c.Fold(nick)] = account{name: name, seen: time.Now()}
+	c.accounts.lock.Unlock()
+}
+
+// noAccount for nick, after a WHO or WHOIS reply without one. Servers without accounts never show them,
+// so the master can still be verified with NickServ.
+func (c *Connection) noAccount(nick string) {
+	c.accounts.lock.Lock()
+	c.accounts.byNick[c.Fold(nick)] = account{seen: time.Now(), guess: true}
+	c.accounts.lock.Unlock()
+}
+
+// serverAccount is Account, only if the server said so (not noAccount)
+func (c *Connection) serverAccount(nick string) (name string, ok bool) {
+	c.accounts.lock.Lock()
+	a, found := c.accounts.byNick[c.Fold(nick)]
+	c.accounts.lock.Unlock()
+	if !found || a.guess {
+		return "", false
+	}
+	return c.Account(nick)
+}
+
+// Account returns the services account of nick, empty if not logged in.
+// known is false if we don't know, see Connection.Identify.
+func (c *Connection) Account(nick string) (name string, known bool) {
+	c.accounts.lock.Lock()
+	defer c.accounts.lock.Unlock()
+	a, ok := c.accounts.byNick[c.Fold(nick)]
+	if !ok {
+		return "", false
+	}
+	// without account-notify, we would not hear about logouts
+	if !c.HasCapability("account-notify") && time.Now().Sub(a.seen) > accountTTL {
+		return "", false
+	}
+	return a.name, true
+}
+
+// learnAccount from every message, and runs pending commands when verification is done
+func (c *Connection) learnAccount(irc *IRC) {
+	param := func(i int) string {
+		if i < len(irc.Params) {
+			return irc.Params[i]
+		}
+		return ""
+	}
+	// account-tag is on every message from a logged in user
+	if irc.Nick != "" && irc.User != "" {
+		if name, ok := irc.Tags["account"]; ok {
+			c.setAccount(irc.Nick, name)
+		} else if c.HasCapability("account-tag") {
+			c.setAccount(irc.Nick, "")
+		}
+	}
+	switch irc.Verb {
+	case "ACCOUNT": // account-notify
+		c.setAccount(irc.Nick, param(0))
+		c.forgetMaster(irc.Nick)
+	case "JOIN":
+		// extended-join: JOIN #channel account :realname
+		if len(irc.Params) == 3 {
+			c.setAccount(irc.Nick, param(1))
+		}
+	case "NICK":
+		c.forgetMaster(irc.Nick)
+		c.forgetMaster(param(0))
+		c.accounts.lock.Lock()
+		old, nick := c.Fold(irc.Nick), c.Fold(param(0))
+		if a, ok := c.accounts.byNick[old]; ok {
+			c.accounts.byNick[nick] = a
+		}
+		delete(c.accounts.byNick, old)
+		c.accounts.lock.Unlock()
+	case "QUIT":
+		c.forgetMaster(irc.Nick)
+		c.accounts.lock.Lock()
+		delete(c.accounts.byNick, c.Fold(irc.Nick))
+		c.accounts.lock.Unlock()
+	case "354": // RPL_WHOSPCRPL: bot 616 nick account
+		if param(1) == whoxToken {
+			c.setAccount(param(2), param(3))
+		}
+	case "330": // RPL_WHOISACCOUNT: bot nick account :is logged in as
+		c.setAccount(param(1), param(2))
+	case "315", "318", "401": // end of WHO, end of WHOIS, no such nick
+		nick := param(1)
+		if _, known := c.Account(nick); !known {
+			c.noAccount(nick)
+		}
+		c.verified(nick)
+	case "NOTICE":
+		if c.EqualFold(irc.Nick, "NickServ") {
+			c.nickservAuth(irc)
+		}
+	}
+}
+
+// nickservAuth handles NickServ replies to MasterCheck:
+// 'nick ACC 3', 'nick -> account ACC 3' or 'STATUS nick 3'
+func (c *Connection) nickservAuth(irc *IRC) {
+	fields := strings.Fields(irc.Message)
+	var nick, level string
+	for i, f := range fields {
+		switch {
+		case f == "ACC" && i > 0 && i+1 < len(fields):
+			nick, level = fields[0], fields[i+1]
+		case f == "STATUS" && i == 0 && len(fields) > 2:
+			nick, level = fields[1], fields[2]
+		}
+	}
+	if nick == "" {
+		return
+	}
+	if level == "3" && c.EqualFold(nick, c.masterName()) {
+		c.masterauth = time.Now()
+	}
+	c.verified(nick)
+}
+
+// isMaster returns true if irc is from the master (see Config.Master), logged in to the master's account,
+// or, if the server does not show accounts, identified to NickServ in the last 5 minutes.
+func (c *Connection) isMaster(irc *IRC) bool {
+	if irc.Nick == "" || !c.EqualFold(irc.Nick, c.masterName()) {
+		return false
+	}
+	if c.config.AuthMode == -1 {
+		return true
+	}
+	if name, ok := c.serverAccount(irc.Nick); ok {
+		// logged out, or someone else with the master's nick
+		return name != "" && c.EqualFold(name, c.masterName())
+	}
+	return time.Now().Sub(c.masterauth) < accountTTL
+}
+
+// forgetMaster forgets the NickServ check if nick is the master's, when it changes hands or logs out
+func (c *Connection) forgetMaster(nick string) {
+	if nick != "" && c.EqualFold(nick, c.masterName()) {
+		c.masterauth = time.Time{}
+	}
+}
+
+// authorize calls run if whoever sent irc has at least role.
+// If we don't know who they are yet, run waits until they are verified (or not).
+// Returns false if denied right away.
+func (c *Connection) authorize(irc *IRC, role Role, run func()) bool {
+	if c.Role(irc) >= role {
+		run()
+		return true
+	}
+	if irc.Nick == "" || !c.verify(irc.Nick) {
+		c.Log.Printf("command %q needs %s, denied: %s", irc.Command, role, irc.Prefix)
+		return false
+	}
+	c.Log.Printf("command %q needs %s, verifying: %s", irc.Command, role, irc.Prefix)
+	p := &pending{irc: irc, role: role, run: run}
+	folded := c.Fold(irc.Nick)
+	c.accounts.lock.Lock()
+	c.accounts.pending[folded] = append(c.accounts.pending[folded], p)
+	c.accounts.lock.Unlock()
+	time.AfterFunc(verifyTimeout, func() {
+		if c.takePending(folded, p) {
+			// Send reads the config, which handlers change
+			c.Do(func() { irc.ReplyUser(c, "could not verify your account, try again later") })
+		}
+	})
+	return true
+}
+
+// takePending removes p, returning false if it was already taken
+func (c *Connection) takePending(folded string, p *pending) bool {
+	c.accounts.lock.Lock()
+	defer c.accounts.lock.Unlock()
+	list := c.accounts.pending[folded]
+	for i := range list {
+		if list[i] == p {
+			c.accounts.pending[folded] = append(list[:i], list[i+1:]...)
+			if len(c.accounts.pending[folded]) == 0 {
+				delete(c.accounts.pending, folded)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// verify asks the server about nick, returning false if there is nothing more to learn.
+//
+// WHOX is used if the server has it, WHOIS if not (or when there are certificate grants).
+// For the master, NickServ is asked if the server did not show an account (see Config.AuthMode).
+func (c *Connection) verify(nick string) bool {
+	folded := c.Fold(nick)
+	c.accounts.lock.Lock()
+	asked, waiting := c.accounts.asked[folded], len(c.accounts.pending[folded]) != 0
+	c.accounts.lock.Unlock()
+	if waiting && time.Now().Sub(asked) < verifyTimeout {
+		// already asked, wait with the others
+		return true
+	}
+	name, known := c.Account(nick)
+	_, reported := c.serverAccount(nick)
+	c.certfps.lock.Lock()
+	_, haveFP := c.certfps.byNick[folded]
+	c.certfps.lock.Unlock()
+	switch {
+	case !known || (!haveFP && c.hasCertGrants() && time.Now().Sub(asked) > accountTTL):
+		c.accounts.lock.Lock()
+		c.accounts.asked[folded] = time.Now()
+		c.accounts.lock.Unlock()
+		if _, whox := c.ISupport().Tokens["WHOX"]; whox && !c.hasCertGrants() {
+			c.Write([]byte("WHO " + nick + " %tna," + whoxToken))
+		} else {
+			c.Write([]byte("WHOIS " + nick))
+		}
+		return true
+	case c.EqualFold(nick, c.masterName()) && name == "" && !reported && c.config.AuthMode != -1:
+		c.accounts.lock.Lock()
+		recently := time.Now().Sub(c.accounts.nickserv) < verifyTimeout
+		if !recently {
+			c.accounts.nickserv = time.Now()
+		}
+		c.accounts.lock.Unlock()
+		if recently {
+			return false
+		}
+		c.MasterCheck()
+		return true
+	}
+	return false
+}
+
+// verified runs or denies the commands waiting for nick
+func (c *Connection) verified(nick string) {
+	folded := c.Fold(nick)
+	c.accounts.lock.Lock()
+	list := c.accounts.pending[folded]
+	delete(c.accounts.pending, folded)
+	c.accounts.lock.Unlock()
+	var retry []*pending
+	for _, p := range list {
+		switch {
+		case c.Role(p.irc) >= p.role:
+			p.run()
+		case c.verify(nick):
+			// the master, asking NickServ now
+			retry = append(retry, p)
+		default:
+			c.Log.Printf("command %q needs %s, denied after verifying: %s", p.irc.Command, p.role, p.irc.Prefix)
+			p.irc.ReplyUser(c, "you need "+p.role.String()+" for that")
+		}
+	}
+	if len(retry) != 0 {
+		c.accounts.lock.Lock()
+		c.accounts.pending[folded] = append(c.accounts.pending[folded], retry...)
+		c.accounts.lock.Unlock()
+	}
+}
+
+// hasCertGrants returns true if any role is granted to a certificate fingerprint
+func (c *Connection) hasCertGrants() bool {
+	for _, g := range c.Grants("") {
+		if strings.HasPrefix(g.Mask, "certfp:") {
+			return true
+		}
+	}
+	return false
+}
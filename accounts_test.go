@@ -0,0 +1,111 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAccountAuth(t *testing.T) {
+	c := NewTestConnection()
+	c.config = &Config{Nick: "testing", Master: "tester:$", CommandPrefix: "!"}
+	tc := c.conn.(*testconnection)
+	var ran int
+	c.MasterMap = map[string]Command{"hi": func(c *Connection, irc *IRC) { ran++ }}
+	feed := func(line string) {
+		irc := c.config.Parse(line)
+		c.learnAccount(irc)
+		if irc.Verb == "PRIVMSG" {
+			commandHandler(c, irc)
+		}
+	}
+
+	// unknown account, asks the server
+	feed(":tester!u@h PRIVMSG testing :$hi")
+	if ran != 0 || !strings.Contains(tc.buf.String(), "WHOIS tester") {
+		t.Fatalf("expected WHOIS, got %q (ran %v)", tc.buf.String(), ran)
+	}
+	tc.buf.Reset()
+	feed(":server 330 testing tester tester :is logged in as")
+	feed(":server 318 testing tester :End of /WHOIS list.")
+	if ran != 1 {
+		t.Fatalf("pending command did not run after WHOIS")
+	}
+
+	// known account, runs now
+	feed(":tester!u@h PRIVMSG testing :$hi")
+	if ran != 2 {
+		t.Fatalf("command did not run with known account")
+	}
+
+	// logged out (account-notify), the server knows better than NickServ
+	tc.buf.Reset()
+	feed(":tester!u@h ACCOUNT *")
+	feed(":tester!u@h PRIVMSG testing :$hi")
+	if ran != 2 || strings.Contains(tc.buf.String(), "NickServ") {
+		t.Fatalf("expected denied, got %q (ran %v)", tc.buf.String(), ran)
+	}
+
+	// no account shown by WHOIS, NickServ is asked
+	c.accounts.reset()
+	feed(":tester!u@h PRIVMSG testing :$hi")
+	feed(":server 318 testing tester :End of /WHOIS list.")
+	if ran != 2 || !strings.Contains(tc.buf.String(), "PRIVMSG NickServ :ACC tester") {
+		t.Fatalf("expected NickServ ACC, got %q (ran %v)", tc.buf.String(), ran)
+	}
+	feed(":NickServ!NickServ@services. NOTICE testing :tester -> tester ACC 3")
+	if ran != 3 {
+		t.Fatalf("pending command did not run after NickServ")
+	}
+
+	// someone else, WHOX
+	c.isupport.Tokens["WHOX"] = ""
+	tc.buf.Reset()
+	feed(":other!u@h PRIVMSG testing :$hi")
+	if !strings.Contains(tc.buf.String(), "WHO other %tna,616") {
+		t.Fatalf("expected WHOX, got %q", tc.buf.String())
+	}
+	tc.buf.Reset()
+	feed(":server 354 testing 616 other 0")
+	feed(":server 315 testing other :End of /WHO list.")
+	if ran != 3 || !strings.Contains(tc.buf.String(), "you need admin") {
+		t.Fatalf("expected denied, got %q (ran %v)", tc.buf.String(), ran)
+	}
+
+	// account-tag
+	feed("@account=someone :someone!u@h PRIVMSG #chan :hi")
+	if name, known := c.Account("SomeOne"); !known || name != "someone" {
+		t.Errorf("account-tag: %q %v", name, known)
+	}
+}
+
+func TestMasterImpersonation(t *testing.T) {
+	c := NewTestConnection()
+	c.config = &Config{Nick: "testing", Master: "tester:$", CommandPrefix: "!"}
+	feed := func(line string) {
+		c.learnAccount(c.config.Parse(line))
+	}
+	master := func(line string) bool {
+		return c.isMaster(c.config.Parse(line))
+	}
+
+	// identified to NickServ
+	feed(":NickServ!NickServ@services. NOTICE testing :tester ACC 3")
+	if !master(":tester!u@h PRIVMSG testing :$hi") {
+		t.Fatalf("expected master after NickServ")
+	}
+	// someone else's account, even right after NickServ
+	feed(":server 330 testing tester eve :is logged in as")
+	if master(":tester!u@h PRIVMSG testing :$hi") {
+		t.Errorf("expected someone logged in as eve not to be master")
+	}
+
+	// the master leaves, someone else takes the nick
+	for _, leave := range []string{":tester!u@h QUIT :bye", ":tester!u@h NICK away", ":tester!u@h ACCOUNT *"} {
+		c.accounts.reset()
+		feed(":NickServ!NickServ@services. NOTICE testing :tester ACC 3")
+		feed(leave)
+		if master(":tester!eve@elsewhere PRIVMSG testing :$hi") {
+			t.Errorf("%q: expected NickServ check forgotten", leave)
+		}
+	}
+}
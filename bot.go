@@ -0,0 +1,360 @@
+package ircb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	diamond "github.com/aerth/diamond/lib"
+	"github.com/boltdb/bolt"
+)
+
+// BotConfig lists the networks of a Bot.
+// The global options are the defaults for each network, which only need what is different:
+//
+//  {
+//   "Nick": "mustangsally",
+//   "Master": "aerth:$",
+//   "Networks": [
+//    {"Network": "freenode", "Host": "chat.freenode.net:6697", "Channels": "##ircb"},
+//    {"Network": "oftc", "Host": "irc.oftc.net:6697", "Nick": "sally"}
+//   ]
+//  }
+//
+type BotConfig struct {
+	Config             // global options
+	Networks []*Config // each with a unique Network name
+}
+
+// BotConfigFromJSON loads a new bot config from json encoded bytes.
+// Each network starts with the global options, which start with NewDefaultConfig.
+func BotConfigFromJSON(b []byte) (*BotConfig, error) {
+	global, err := ConfigFromJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Networks []json.RawMessage
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	bc := &BotConfig{Config: *global}
+	names := make(map[string]bool)
+	for i, network := range raw.Networks {
+		config, err := ConfigFromJSON(b)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(network, config); err != nil {
+			return nil, err
+		}
+		if config.Network == "" {
+			return nil, fmt.Errorf("network %v has no name", i)
+		}
+		if names[config.Network] {
+			return nil, fmt.Errorf("network %q is listed twice", config.Network)
+		}
+		names[config.Network] = true
+		bc.Networks = append(bc.Networks, config)
+	}
+	return bc, nil
+}
+
+// Marshal into json encoded bytes, networks only have options different from global
+func (bc BotConfig) Marshal() ([]byte, error) {
+	global, err := json.Marshal(bc.Config)
+	if err != nil {
+		return nil, err
+	}
+	var defaults map[string]json.RawMessage
+	if err := json.Unmarshal(global, &defaults); err != nil {
+		return nil, err
+	}
+	var networks []map[string]json.RawMessage
+	for _, config := range bc.Networks {
+		b, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		var network map[string]json.RawMessage
+		if err := json.Unmarshal(b, &network); err != nil {
+			return nil, err
+		}
+		for k, v := range network {
+			if k != "Network" && string(defaults[k]) == string(v) {
+				delete(network, k)
+			}
+		}
+		networks = append(networks, network)
+	}
+	b, err := json.Marshal(networks)
+	if err != nil {
+		return nil, err
+	}
+	defaults["Networks"] = b
+	return json.MarshalIndent(defaults, " ", " ")
+}
+
+// Bot runs a Connection for each network in one process.
+// All networks share one database, namespaced by network name,
+// and the Bot's command maps, which each Connection's maps can override.
+type Bot struct {
+	Log        *log.Logger
+	CommandMap map[string]Command // public commands for all networks
+	MasterMap  map[string]Command // master commands for all networks
+	ConfigFile string             // for reloading, see Reload (can be empty to use config.json)
+	registry   *Registry          // documented commands for all networks
+	config     *BotConfig
+	configlock sync.Mutex // guards config after connecting, see Reload
+	boltdb     *bolt.DB
+	diamond    *diamond.System
+	networks   map[string]*Connection
+	maplock    sync.Mutex // guards (both) command map writes
+}
+
+// NewBot returns an unconnected bot with a Connection for each network
+func (bc *BotConfig) NewBot() *Bot {
+	if bc.Database == "" {
+		bc.Database = "bolt.db"
+	}
+	b := new(Bot)
+	b.config = bc
+	b.CommandMap = DefaultCommandMap()
+	b.MasterMap = DefaultMasterMap()
+	b.registry = DefaultRegistry()
+	b.networks = make(map[string]*Connection)
+	b.Log = log.New(os.Stderr, "", log.Ltime)
+	for _, config := range bc.Networks {
+		// the bot has the diamond and database, one for all
+		config.Diamond = false
+		config.Database = bc.Database
+		c := config.NewConnection()
+		c.bot = b
+		c.CommandMap = make(map[string]Command)
+		c.MasterMap = make(map[string]Command)
+		c.registry = NewRegistry()
+		c.Log.SetPrefix("[" + config.Network + "] ")
+		b.networks[config.Network] = c
+	}
+	return b
+}
+
+// Connect opens the database and connects to every network, returning when all are closed
+func (b *Bot) Connect() (err error) {
+	if b.config.Diamond {
+		if b.config.DiamondSocket == "" {
+			b.config.DiamondSocket = "control.socket"
+		}
+		b.diamond, err = diamond.New(b.config.DiamondSocket)
+		if err != nil {
+			return err
+		}
+		b.diamond.Config.Kickable = true
+		b.diamond.SetRunlevel(0, func() error {
+			return b.Close()
+		})
+		b.diamond.SetRunlevel(1, func() error { return nil })
+		b.diamond.Runlevel(1)
+	}
+	b.boltdb, err = loadDatabase(b.config.Database)
+	if err != nil {
+		return err
+	}
+	defer b.boltdb.Close()
+	for name := range b.networks {
+		if err := b.createNetworkBuckets(name); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(b.networks))
+	for name, c := range b.networks {
+		c.boltdb = b.boltdb
+		wg.Add(1)
+		go func(name string, c *Connection) {
+			defer wg.Done()
+			err := c.Connect()
+			b.Log.Printf("network %q stopped: %v", name, err)
+			errs <- err
+		}(name, c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close every network connection and the database
+func (b *Bot) Close() error {
+	for _, c := range b.networks {
+		c.Close()
+	}
+	os.Remove("diamond.socket")
+	if b.boltdb != nil {
+		return b.boltdb.Close()
+	}
+	return nil
+}
+
+// Network returns the named network's Connection, or nil
+func (b *Bot) Network(name string) *Connection {
+	return b.networks[name]
+}
+
+// Networks returns the sorted network names
+func (b *Bot) Networks() []string {
+	var names []string
+	for name := range b.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Database returns the shared database, will be nil if not connected
+func (b *Bot) Database() *bolt.DB {
+	return b.boltdb
+}
+
+// Diamond returns the bot's diamond system, will be nil if not connected or not configured with 'Diamond: true'
+func (b *Bot) Diamond() *diamond.System {
+	return b.diamond
+}
+
+// MarshalConfig encodes the bot's config as JSON, including runtime changes to networks
+func (b *Bot) MarshalConfig() []byte {
+	b.configlock.Lock()
+	bc := *b.config
+	networks := append([]*Config(nil), b.config.Networks...)
+	b.configlock.Unlock()
+	bc.Networks = nil
+	for _, config := range networks {
+		network := *config
+		if c := b.networks[config.Network]; c != nil && c.nick != "" {
+			network.Nick = c.nick
+		}
+		bc.Networks = append(bc.Networks, &network)
+	}
+	out, _ := bc.Marshal()
+	return out
+}
+
+// AddCommand adds a new public command for all networks, wrapped with any middleware
+func (b *Bot) AddCommand(name string, fn Command, mw ...Middleware) {
+	b.maplock.Lock()
+	defer b.maplock.Unlock()
+	b.CommandMap[name] = Chain(fn, mw...)
+}
+
+// AddMasterCommand adds a new master command for all networks, wrapped with any middleware
+func (b *Bot) AddMasterCommand(name string, fn Command, mw ...Middleware) {
+	b.maplock.Lock()
+	defer b.maplock.Unlock()
+	b.MasterMap[name] = Chain(fn, mw...)
+}
+
+// networkBucket is the top level bucket holding a network's buckets
+func networkBucket(name string) []byte {
+	return []byte("network:" + name)
+}
+
+// createNetworkBuckets makes a network's buckets if not exist
+func (b *Bot) createNetworkBuckets(name string) error {
+	return b.boltdb.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(networkBucket(name))
+		if err != nil {
+			return err
+		}
+		return createBuckets(bucket)
+	})
+}
+
+// Bot returns the Bot running this Connection, or nil
+func (c *Connection) Bot() *Bot {
+	return c.bot
+}
+
+// Network returns the network name from Config.Network, can be empty if not running in a Bot
+func (c *Connection) Network() string {
+	return c.config.Network
+}
+
+// bucket returns a database bucket, the network's own when running in a Bot
+func (c *Connection) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	if c.bot == nil {
+		return tx.Bucket(name)
+	}
+	network := tx.Bucket(networkBucket(c.config.Network))
+	if network == nil {
+		return nil
+	}
+	return network.Bucket(name)
+}
+
+// command returns the named public command, a network's own before the Bot's
+func (c *Connection) command(name string) (Command, bool) {
+	c.maplock.Lock()
+	fn, ok := c.CommandMap[name]
+	c.maplock.Unlock()
+	if ok || c.bot == nil {
+		return fn, ok
+	}
+	c.bot.maplock.Lock()
+	defer c.bot.maplock.Unlock()
+	fn, ok = c.bot.CommandMap[name]
+	return fn, ok
+}
+
+// masterCommand returns the named master command, a network's own before the Bot's
+func (c *Connection) masterCommand(name string) (Command, bool) {
+	c.maplock.Lock()
+	fn, ok := c.MasterMap[name]
+	c.maplock.Unlock()
+	if ok || c.bot == nil {
+		return fn, ok
+	}
+	c.bot.maplock.Lock()
+	defer c.bot.maplock.Unlock()
+	fn, ok = c.bot.MasterMap[name]
+	return fn, ok
+}
+
+// commandNames returns the sorted names of public commands, or master commands
+func (c *Connection) commandNames(master bool) []string {
+	maps := []map[string]Command{c.CommandMap}
+	if master {
+		maps[0] = c.MasterMap
+	}
+	if c.bot != nil {
+		c.bot.maplock.Lock()
+		defer c.bot.maplock.Unlock()
+		if master {
+			maps = append(maps, c.bot.MasterMap)
+		} else {
+			maps = append(maps, c.bot.CommandMap)
+		}
+	}
+	c.maplock.Lock()
+	defer c.maplock.Unlock()
+	var list []string
+	seen := make(map[string]bool)
+	for _, m := range maps {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				list = append(list, name)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
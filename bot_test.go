@@ -0,0 +1,110 @@
+package ircb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBotConfig(t *testing.T) {
+	b := []byte(`{"Nick": "sally", "Master": "root:@", "Networks": [
+		{"Network": "one", "Host": "irc.one.net:6697"},
+		{"Network": "two", "Host": "irc.two.net:6697", "Nick": "sal"}
+	]}`)
+	bc, err := BotConfigFromJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bc.Networks) != 2 {
+		t.Fatalf("expected 2 networks, got %v", len(bc.Networks))
+	}
+	one, two := bc.Networks[0], bc.Networks[1]
+	if one.Nick != "sally" || one.Master != "root:@" || one.Host != "irc.one.net:6697" || !one.Karma {
+		t.Errorf("network one: %+v", one)
+	}
+	if two.Nick != "sal" || two.Master != "root:@" {
+		t.Errorf("network two: %+v", two)
+	}
+
+	// only differences are saved
+	out, err := bc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := BotConfigFromJSON(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Networks[1].Nick != "sal" || again.Networks[0].Nick != "sally" {
+		t.Errorf("round trip: %s", out)
+	}
+
+	// with the running nicks
+	bot := bc.NewBot()
+	bot.Network("two").nick = "sal2"
+	again, err = BotConfigFromJSON(bot.MarshalConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Networks) != 2 || again.Networks[0].Network != "one" || again.Networks[0].Nick != "sally" ||
+		again.Networks[1].Network != "two" || again.Networks[1].Nick != "sal2" {
+		t.Errorf("marshal bot: %s", bot.MarshalConfig())
+	}
+
+	for _, bad := range []string{
+		`{"Networks": [{"Host": "irc.one.net:6697"}]}`,
+		`{"Networks": [{"Network": "one"}, {"Network": "one"}]}`,
+	} {
+		if _, err := BotConfigFromJSON([]byte(bad)); err == nil {
+			t.Errorf("expected error: %s", bad)
+		}
+	}
+}
+
+func TestBotDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bc, err := BotConfigFromJSON([]byte(`{"Networks": [{"Network": "one"}, {"Network": "two"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Database = filepath.Join(dir, "bolt.db")
+	bot := bc.NewBot()
+	bot.boltdb, err = loadDatabase(bc.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.boltdb.Close()
+	for _, name := range bot.Networks() {
+		if err := bot.createNetworkBuckets(name); err != nil {
+			t.Fatal(err)
+		}
+		bot.Network(name).boltdb = bot.boltdb
+	}
+
+	one, two := bot.Network("one"), bot.Network("two")
+	one.addKarma(KarmaEvent{To: "gopher", Delta: 1})
+	one.addKarma(KarmaEvent{To: "gopher", Delta: 1})
+	two.addKarma(KarmaEvent{To: "gopher", Delta: -1})
+	if got := one.karmaShow("", "gopher"); got != "2" {
+		t.Errorf("network one karma: %q", got)
+	}
+	if got := two.karmaShow("", "gopher"); got != "-1" {
+		t.Errorf("network two karma: %q", got)
+	}
+
+	// shared commands, with overrides
+	bot.AddCommand("hi", func(c *Connection, irc *IRC) {})
+	if _, ok := one.command("hi"); !ok {
+		t.Errorf("shared command not found")
+	}
+	one.RemoveCommand("hi")
+	two.AddCommand("only", func(c *Connection, irc *IRC) {})
+	if _, ok := one.command("only"); ok {
+		t.Errorf("network command found on other network")
+	}
+}
@@ -0,0 +1,236 @@
+package ircb
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultCapabilities are requested if the server has them, see Config.Capabilities
+var DefaultCapabilities = []string{
+	"message-tags",
+	"server-time",
+	"account-notify",
+	"account-tag",
+	"extended-join",
+	"away-notify",
+	"multi-prefix",
+	"sasl",
+	"echo-message",
+}
+
+// Capabilities returns the sorted list of capabilities enabled by the server
+func (c *Connection) Capabilities() []string {
+	c.caplock.Lock()
+	defer c.caplock.Unlock()
+	var list []string
+	for name := range c.caps {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// HasCapability returns true if the named capability is enabled
+func (c *Connection) HasCapability(name string) bool {
+	c.caplock.Lock()
+	defer c.caplock.Unlock()
+	_, ok := c.caps[name]
+	return ok
+}
+
+// CapabilityValue returns the value advertised by the server, such as 'PLAIN,EXTERNAL' for 'sasl'
+func (c *Connection) CapabilityValue(name string) (value string, ok bool) {
+	c.caplock.Lock()
+	defer c.caplock.Unlock()
+	value, ok = c.capsAvailable[name]
+	return value, ok
+}
+
+// wantedCapabilities returns the capabilities we want that are available and not yet enabled
+func (c *Connection) wantedCapabilities() []string {
+	c.caplock.Lock()
+	defer c.caplock.Unlock()
+	var list []string
+	wanted := c.config.Capabilities
+	if c.config.SASL != "" {
+		wanted = append([]string{"sasl"}, wanted...)
+	}
+	for _, name := range wanted {
+		if _, ok := c.capsAvailable[name]; !ok {
+			continue
+		}
+		if _, ok := c.caps[name]; ok {
+			continue
+		}
+		if contains(list, name) {
+			continue
+		}
+		list = append(list, name)
+	}
+	return list
+}
+
+// negotiate reads server messages during registration until CAP END is sent
+// Servers without CAP support will reply 421 or go straight to 001.
+func (c *Connection) negotiate() error {
+	for {
+		msg, err := c.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if c.config.Verbose {
+			c.Log.Printf("read: %q", msg)
+		}
+		irc := Parse(msg)
+		if irc == nil {
+			continue
+		}
+		switch irc.Verb {
+		default:
+			c.Log.Println(irc.Verb, irc.Message)
+		case "PING":
+			pong := IRC{Verb: "PONG", Params: irc.Params}
+			if _, err := c.Write(pong.Encode()); err != nil {
+				return err
+			}
+		case "CAP":
+			done, err := c.capHandler(irc)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		case "AUTHENTICATE", "900", "902", "903", "904", "905", "906", "907", "908":
+			done, err := c.saslHandler(irc)
+			if err != nil {
+				return err
+			}
+			if done {
+				return nil
+			}
+		case "432", "433", "436":
+			c.nickError(irc)
+		case "001", "421":
+			if c.config.SASL != "" {
+				return ErrSASLUnavailable
+			}
+			c.Log.Println("no capability negotiation:", irc.Message)
+			return nil
+		}
+	}
+}
+
+// capHandler handles CAP messages, returning true if CAP END was sent
+// An error is returned if SASL is configured and could not be started.
+func (c *Connection) capHandler(irc *IRC) (bool, error) {
+	if len(irc.Params) < 3 {
+		c.Log.Println("bad CAP message:", irc)
+		return false, nil
+	}
+	subcommand := strings.ToUpper(irc.Params[1])
+	list := strings.Fields(irc.Params[len(irc.Params)-1])
+	more := len(irc.Params) > 3 && irc.Params[2] == "*"
+
+	switch subcommand {
+	default:
+		c.Log.Println("CAP", subcommand, list)
+	case "LS", "NEW":
+		c.caplock.Lock()
+		for _, v := range list {
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) == 2 {
+				c.capsAvailable[kv[0]] = kv[1]
+			} else {
+				c.capsAvailable[kv[0]] = ""
+			}
+		}
+		c.caplock.Unlock()
+		if more {
+			return false, nil
+		}
+		if !c.registered && c.config.SASL != "" {
+			if _, ok := c.CapabilityValue("sasl"); !ok {
+				return false, ErrSASLUnavailable
+			}
+		}
+		if req := c.wantedCapabilities(); len(req) != 0 {
+			c.Log.Println("requesting capabilities:", req)
+			c.Write([]byte("CAP REQ :" + strings.Join(req, " ")))
+			return false, nil
+		}
+		if subcommand == "LS" {
+			return c.capEnd(), nil
+		}
+	case "DEL":
+		c.caplock.Lock()
+		for _, name := range list {
+			delete(c.capsAvailable, name)
+			delete(c.caps, name)
+		}
+		c.caplock.Unlock()
+		c.Log.Println("capabilities removed:", list)
+	case "ACK":
+		c.caplock.Lock()
+		for _, name := range list {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps, name[1:])
+				continue
+			}
+			c.caps[name] = c.capsAvailable[name]
+		}
+		c.caplock.Unlock()
+		c.Log.Println("capabilities enabled:", list)
+		if !c.registered {
+			if c.config.SASL != "" && c.HasCapability("sasl") {
+				return false, c.saslStart()
+			}
+			return c.capEnd(), nil
+		}
+	case "NAK":
+		c.Log.Println("capabilities rejected:", list)
+		if !c.registered {
+			if c.config.SASL != "" && contains(list, "sasl") {
+				return false, ErrSASLUnavailable
+			}
+			return c.capEnd(), nil
+		}
+	}
+	return false, nil
+}
+
+// contains returns true if list has s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// capEnd ends capability negotiation
+func (c *Connection) capEnd() bool {
+	if _, err := c.Write([]byte("CAP END")); err != nil {
+		c.Log.Println(err)
+	}
+	return true
+}
+
+// resetCapabilities before connecting
+func (c *Connection) resetCapabilities() {
+	c.caplock.Lock()
+	defer c.caplock.Unlock()
+	c.caps = make(map[string]string)
+	c.capsAvailable = make(map[string]string)
+}
+
+// capLS starts capability negotiation, if any capabilities or SASL are configured
+func (c *Connection) capLS() (bool, error) {
+	c.resetCapabilities()
+	if len(c.config.Capabilities) == 0 && c.config.SASL == "" {
+		return false, nil
+	}
+	_, err := c.Write([]byte("CAP LS 302"))
+	return err == nil, err
+}
@@ -0,0 +1,116 @@
+package ircb
+
+import (
+	"bufio"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("sally\x00sally\x00hunter2"))
+	for _, tt := range []struct {
+		name     string
+		caps     []string
+		sasl     string
+		server   string // lines from the server
+		expected string // lines sent, after CAP LS
+		err      string
+	}{
+		{"no caps", nil, "", "", "", ""},
+		{"requested", []string{"multi-prefix", "away-notify"}, "",
+			"CAP * LS * :multi-prefix sasl\r\nCAP * LS :away-notify\r\nCAP * ACK :multi-prefix away-notify\r\n",
+			"CAP REQ :multi-prefix away-notify\r\nCAP END\r\n", ""},
+		{"none available", []string{"multi-prefix"}, "",
+			"CAP * LS :sasl\r\n",
+			"CAP END\r\n", ""},
+		{"rejected", []string{"multi-prefix"}, "",
+			"CAP * LS :multi-prefix\r\nCAP * NAK :multi-prefix\r\n",
+			"CAP REQ :multi-prefix\r\nCAP END\r\n", ""},
+		{"sasl without capabilities", nil, "PLAIN",
+			"CAP * LS :sasl=PLAIN,EXTERNAL\r\nCAP * ACK :sasl\r\nAUTHENTICATE +\r\n:host.test 900 * sally!u@h sally :You are now logged in\r\n:host.test 903 * :SASL authentication successful\r\n",
+			"CAP REQ :sasl\r\nAUTHENTICATE PLAIN\r\nAUTHENTICATE " + plain + "\r\nCAP END\r\n", ""},
+		{"sasl external", []string{"multi-prefix"}, "EXTERNAL",
+			"CAP * LS :multi-prefix sasl\r\nCAP * ACK :sasl multi-prefix\r\nAUTHENTICATE +\r\n:host.test 903 * :SASL authentication successful\r\n",
+			"CAP REQ :sasl multi-prefix\r\nAUTHENTICATE EXTERNAL\r\nAUTHENTICATE +\r\nCAP END\r\n", ""},
+		{"sasl not offered", nil, "PLAIN",
+			"CAP * LS :multi-prefix\r\n",
+			"", "sasl not available"},
+		{"sasl rejected", nil, "PLAIN",
+			"CAP * LS :sasl\r\nCAP * NAK :sasl\r\n",
+			"CAP REQ :sasl\r\n", "sasl not available"},
+		{"sasl mechanism", nil, "PLAIN",
+			"CAP * LS :sasl=EXTERNAL\r\nCAP * ACK :sasl\r\n",
+			"CAP REQ :sasl\r\n", "not in server list"},
+		{"sasl failed", nil, "PLAIN",
+			"CAP * LS :sasl\r\nCAP * ACK :sasl\r\nAUTHENTICATE +\r\n:host.test 904 * :SASL authentication failed\r\n",
+			"CAP REQ :sasl\r\nAUTHENTICATE PLAIN\r\nAUTHENTICATE " + plain + "\r\n", "sasl authentication failed (904)"},
+		{"no cap support", nil, "PLAIN",
+			":host.test 421 * CAP :Unknown command\r\n",
+			"", "sasl not available"},
+	} {
+		c := NewTestConnection()
+		c.config.Nick = "sally"
+		c.config.Capabilities = tt.caps
+		c.config.SASL, c.config.SASLPass = tt.sasl, "hunter2"
+		tc := c.conn.(*testconnection)
+		c.reader = bufio.NewReader(strings.NewReader(tt.server))
+		negotiating, err := c.capLS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if negotiating != (tt.server != "") {
+			t.Errorf("%s: negotiating: %v", tt.name, negotiating)
+			continue
+		}
+		if !negotiating {
+			continue
+		}
+		if sent, _ := tc.buf.ReadString('\n'); sent != "CAP LS 302\r\n" {
+			t.Errorf("%s: expected CAP LS, got %q", tt.name, sent)
+		}
+		err = c.negotiate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+		}
+		if tc.buf.String() != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, tc.buf.String())
+		}
+	}
+}
+
+func TestCapNewDel(t *testing.T) {
+	c := NewTestConnection()
+	c.config.Capabilities = []string{"multi-prefix", "away-notify"}
+	c.resetCapabilities()
+	c.registered = true
+	tc := c.conn.(*testconnection)
+	for _, tt := range []struct {
+		line     string
+		expected string // line sent
+		caps     string // enabled after
+	}{
+		{"CAP sally LS :multi-prefix", "CAP REQ :multi-prefix\r\n", ""},
+		{"CAP sally ACK :multi-prefix", "", "multi-prefix"},
+		{"CAP sally NEW :away-notify chghost", "CAP REQ :away-notify\r\n", "multi-prefix"},
+		{"CAP sally ACK :away-notify", "", "away-notify multi-prefix"},
+		{"CAP sally NEW :chghost", "", "away-notify multi-prefix"},
+		{"CAP sally DEL :away-notify", "", "multi-prefix"},
+		{"CAP sally NEW :away-notify", "CAP REQ :away-notify\r\n", "multi-prefix"},
+		{"CAP sally NAK :away-notify", "", "multi-prefix"},
+	} {
+		tc.buf.Reset()
+		if done, err := c.capHandler(Parse(tt.line)); done || err != nil {
+			t.Errorf("%q: got %v %v", tt.line, done, err)
+		}
+		if tc.buf.String() != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.line, tt.expected, tc.buf.String())
+		}
+		if caps := strings.Join(c.Capabilities(), " "); caps != tt.caps {
+			t.Errorf("%q: expected capabilities %q, got %q", tt.line, tt.caps, caps)
+		}
+	}
+	if _, ok := c.CapabilityValue("away-notify"); !ok {
+		t.Errorf("expected away-notify available again")
+	}
+}
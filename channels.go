@@ -0,0 +1,396 @@
+package ircb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Member of a channel, see Connection.Members
+type Member struct {
+	Nick     string
+	User     string // can be empty until seen
+	Host     string // can be empty until seen
+	Account  string // services account, if known (extended-join, account-notify)
+	Prefixes string // channel privileges, highest first, such as '@+'
+}
+
+// Channel is the state of a joined channel, see Connection.Channel
+type Channel struct {
+	Name      string
+	Topic     string
+	TopicBy   string            // who set the topic
+	TopicTime time.Time         // when the topic was set
+	Modes     map[string]string // channel modes such as 'n' or 'k', with parameter if any
+	Bans      []string          // ban masks
+	Members   map[string]Member // by (case folded) nick
+}
+
+// channelState tracks the channels the bot is in, from JOIN, PART, KICK, QUIT, NICK,
+// MODE, TOPIC and the NAMES, TOPIC, MODE and ban list replies.
+type channelState struct {
+	mu       sync.RWMutex
+	channels map[string]*Channel // by (case folded) name
+
+	// from ISUPPORT, see isupport.go
+	prefixModes   string // such as 'ov'
+	prefixSymbols string // such as '@+'
+	listModes     string // CHANMODES type A, always have a parameter, such as 'b'
+	paramModes    string // CHANMODES type B, always have a parameter, such as 'k'
+	setParamModes string // CHANMODES type C, have a parameter when set, such as 'l'
+	fold          func(string) string
+}
+
+func newChannelState() *channelState {
+	return &channelState{
+		channels:      make(map[string]*Channel),
+		prefixModes:   "ov",
+		prefixSymbols: "@+",
+		listModes:     "beI",
+		paramModes:    "k",
+		setParamModes: "l",
+		fold:          func(s string) string { return fold("rfc1459", s) },
+	}
+}
+
+// reset forgets all channels, returning their names
+func (s *channelState) reset() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, ch := range s.channels {
+		names = append(names, ch.Name)
+	}
+	s.channels = make(map[string]*Channel)
+	sort.Strings(names)
+	return names
+}
+
+// get returns a channel, locked by caller
+func (s *channelState) get(name string) *Channel {
+	return s.channels[s.fold(name)]
+}
+
+// update handles a message from the server, returning true if we joined a channel
+func (s *channelState) update(self string, irc *IRC) (joined bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	param := func(i int) string {
+		if i < len(irc.Params) {
+			return irc.Params[i]
+		}
+		return ""
+	}
+	switch irc.Verb {
+	case "JOIN":
+		name := param(0)
+		if s.fold(irc.Nick) == s.fold(self) {
+			s.channels[s.fold(name)] = &Channel{
+				Name:    name,
+				Modes:   make(map[string]string),
+				Members: make(map[string]Member),
+			}
+			joined = true
+		}
+		ch := s.get(name)
+		if ch == nil {
+			return
+		}
+		m := Member{Nick: irc.Nick, User: irc.User, Host: irc.Host}
+		// extended-join: JOIN #channel account :realname
+		if len(irc.Params) == 3 && param(1) != "*" {
+			m.Account = param(1)
+		}
+		ch.Members[s.fold(irc.Nick)] = m
+	case "PART":
+		s.part(self, param(0), irc.Nick)
+	case "KICK":
+		s.part(self, param(0), param(1))
+	case "QUIT":
+		for _, ch := range s.channels {
+			delete(ch.Members, s.fold(irc.Nick))
+		}
+	case "NICK":
+		old, nick := s.fold(irc.Nick), param(0)
+		for _, ch := range s.channels {
+			if m, ok := ch.Members[old]; ok {
+				delete(ch.Members, old)
+				m.Nick = nick
+				ch.Members[s.fold(nick)] = m
+			}
+		}
+	case "ACCOUNT": // account-notify
+		account := param(0)
+		if account == "*" {
+			account = ""
+		}
+		for _, ch := range s.channels {
+			if m, ok := ch.Members[s.fold(irc.Nick)]; ok {
+				m.Account = account
+				ch.Members[s.fold(irc.Nick)] = m
+			}
+		}
+	case "TOPIC":
+		if ch := s.get(param(0)); ch != nil {
+			ch.Topic = param(1)
+			ch.TopicBy = irc.Nick
+			ch.TopicTime = time.Now()
+		}
+	case "MODE":
+		if ch := s.get(param(0)); ch != nil && len(irc.Params) > 1 {
+			s.mode(ch, irc.Params[1], irc.Params[2:])
+		}
+	case "331": // RPL_NOTOPIC
+		if ch := s.get(param(1)); ch != nil {
+			ch.Topic, ch.TopicBy, ch.TopicTime = "", "", time.Time{}
+		}
+	case "332": // RPL_TOPIC
+		if ch := s.get(param(1)); ch != nil {
+			ch.Topic = param(2)
+		}
+	case "333": // RPL_TOPICWHOTIME
+		if ch := s.get(param(1)); ch != nil {
+			ch.TopicBy, _, _ = splitPrefix(param(2))
+			if unix, err := strconv.ParseInt(param(3), 10, 64); err == nil {
+				ch.TopicTime = time.Unix(unix, 0)
+			}
+		}
+	case "324": // RPL_CHANNELMODEIS
+		if ch := s.get(param(1)); ch != nil && len(irc.Params) > 2 {
+			for mode := range ch.Modes {
+				delete(ch.Modes, mode)
+			}
+			s.mode(ch, irc.Params[2], irc.Params[3:])
+		}
+	case "353": // RPL_NAMREPLY
+		ch := s.get(param(2))
+		if ch == nil {
+			return
+		}
+		for _, name := range strings.Fields(param(3)) {
+			// multi-prefix: '@+nick', userhost-in-names: 'nick!user@host'
+			i := 0
+			for i < len(name) && strings.IndexByte(s.prefixSymbols, name[i]) != -1 {
+				i++
+			}
+			nick, user, host := splitPrefix(name[i:])
+			m := ch.Members[s.fold(nick)]
+			m.Nick, m.Prefixes = nick, s.sortPrefixes(name[:i])
+			if user != "" {
+				m.User, m.Host = user, host
+			}
+			ch.Members[s.fold(nick)] = m
+		}
+	case "367": // RPL_BANLIST
+		if ch := s.get(param(1)); ch != nil && !contains(ch.Bans, param(2)) {
+			ch.Bans = append(ch.Bans, param(2))
+		}
+	}
+	return joined
+}
+
+// part removes nick from channel, or the channel if nick is us
+func (s *channelState) part(self, channel, nick string) {
+	if s.fold(nick) == s.fold(self) {
+		delete(s.channels, s.fold(channel))
+		return
+	}
+	if ch := s.get(channel); ch != nil {
+		delete(ch.Members, s.fold(nick))
+	}
+}
+
+// mode applies a mode string such as '+ov-b nick nick mask!*@*'
+func (s *channelState) mode(ch *Channel, modes string, params []string) {
+	adding := true
+	next := func() string {
+		if len(params) == 0 {
+			return ""
+		}
+		p := params[0]
+		params = params[1:]
+		return p
+	}
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case strings.IndexByte(s.prefixModes, mode) != -1:
+			nick := s.fold(next())
+			m, ok := ch.Members[nick]
+			if !ok {
+				continue
+			}
+			symbol := string(s.prefixSymbols[strings.IndexByte(s.prefixModes, mode)])
+			m.Prefixes = strings.Replace(m.Prefixes, symbol, "", -1)
+			if adding {
+				m.Prefixes = s.sortPrefixes(m.Prefixes + symbol)
+			}
+			ch.Members[nick] = m
+		case strings.IndexByte(s.listModes, mode) != -1:
+			mask := next()
+			if mode != 'b' {
+				continue
+			}
+			if adding {
+				if !contains(ch.Bans, mask) {
+					ch.Bans = append(ch.Bans, mask)
+				}
+				continue
+			}
+			for j, ban := range ch.Bans {
+				if ban == mask {
+					ch.Bans = append(ch.Bans[:j], ch.Bans[j+1:]...)
+					break
+				}
+			}
+		case strings.IndexByte(s.paramModes, mode) != -1,
+			strings.IndexByte(s.setParamModes, mode) != -1 && adding:
+			p := next()
+			if adding {
+				ch.Modes[string(mode)] = p
+			} else {
+				delete(ch.Modes, string(mode))
+			}
+		default:
+			if adding {
+				ch.Modes[string(mode)] = ""
+			} else {
+				delete(ch.Modes, string(mode))
+			}
+		}
+	}
+}
+
+// sortPrefixes sorts prefix symbols, highest first
+func (s *channelState) sortPrefixes(prefixes string) string {
+	var sorted []byte
+	for i := 0; i < len(s.prefixSymbols); i++ {
+		if strings.IndexByte(prefixes, s.prefixSymbols[i]) != -1 {
+			sorted = append(sorted, s.prefixSymbols[i])
+		}
+	}
+	return string(sorted)
+}
+
+// atLeast returns true if prefixes include symbol, or a higher one
+func (s *channelState) atLeast(prefixes string, symbol byte) bool {
+	rank := strings.IndexByte(s.prefixSymbols, symbol)
+	if rank == -1 || prefixes == "" {
+		return false
+	}
+	return strings.IndexByte(s.prefixSymbols[:rank+1], prefixes[0]) != -1
+}
+
+// Channels returns the names of the channels the bot is in
+func (c *Connection) Channels() []string {
+	c.chans.mu.RLock()
+	defer c.chans.mu.RUnlock()
+	var names []string
+	for _, ch := range c.chans.channels {
+		names = append(names, ch.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Channel returns a copy of a joined channel's state
+func (c *Connection) Channel(name string) (channel Channel, ok bool) {
+	c.chans.mu.RLock()
+	defer c.chans.mu.RUnlock()
+	ch := c.chans.get(name)
+	if ch == nil {
+		return channel, false
+	}
+	channel = *ch
+	channel.Modes = make(map[string]string, len(ch.Modes))
+	for k, v := range ch.Modes {
+		channel.Modes[k] = v
+	}
+	channel.Bans = append([]string(nil), ch.Bans...)
+	channel.Members = make(map[string]Member, len(ch.Members))
+	for k, v := range ch.Members {
+		channel.Members[k] = v
+	}
+	return channel, true
+}
+
+// Members returns the members of a joined channel, sorted by nick
+func (c *Connection) Members(channel string) []Member {
+	c.chans.mu.RLock()
+	defer c.chans.mu.RUnlock()
+	ch := c.chans.get(channel)
+	if ch == nil {
+		return nil
+	}
+	var members []Member
+	for _, m := range ch.Members {
+		members = append(members, m)
+	}
+	sort.Sort(byNick(members))
+	return members
+}
+
+type byNick []Member
+
+func (m byNick) Len() int           { return len(m) }
+func (m byNick) Less(i, j int) bool { return m[i].Nick < m[j].Nick }
+func (m byNick) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// Member returns a member of a joined channel
+func (c *Connection) Member(channel, nick string) (member Member, ok bool) {
+	c.chans.mu.RLock()
+	defer c.chans.mu.RUnlock()
+	ch := c.chans.get(channel)
+	if ch == nil {
+		return member, false
+	}
+	member, ok = ch.Members[c.chans.fold(nick)]
+	return member, ok
+}
+
+// IsOp returns true if nick is a channel operator (or higher) in channel
+func (c *Connection) IsOp(channel, nick string) bool {
+	m, ok := c.Member(channel, nick)
+	c.chans.mu.RLock()
+	defer c.chans.mu.RUnlock()
+	return ok && c.chans.atLeast(m.Prefixes, '@')
+}
+
+// IsVoice returns true if nick has voice (or higher) in channel
+func (c *Connection) IsVoice(channel, nick string) bool {
+	m, ok := c.Member(channel, nick)
+	c.chans.mu.RLock()
+	defer c.chans.mu.RUnlock()
+	return ok && c.chans.atLeast(m.Prefixes, '+')
+}
+
+// trackChannels updates channel state, asking for modes and bans of newly joined channels
+func (c *Connection) trackChannels(irc *IRC) {
+	if !c.chans.update(c.config.Nick, irc) {
+		return
+	}
+	c.Log.Println("joined channel:", irc.To)
+	c.Write([]byte("MODE " + irc.To))
+	c.Write([]byte("MODE " + irc.To + " b"))
+}
+
+// autojoin returns Config.Channels, and channels we were in before reconnecting
+func (c *Connection) autojoin() []string {
+	var list []string
+	seen := make(map[string]bool)
+	for _, ch := range append(strings.Split(c.config.Channels, ","), c.rejoin...) {
+		ch = strings.TrimSpace(ch)
+		if ch == "" || seen[c.chans.fold(ch)] {
+			continue
+		}
+		seen[c.chans.fold(ch)] = true
+		list = append(list, ch)
+	}
+	return list
+}
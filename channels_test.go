@@ -0,0 +1,52 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChannelState(t *testing.T) {
+	c := NewTestConnection()
+	for _, line := range []string{
+		":testing!u@h JOIN #ok",
+		":host.test 353 testing = #ok :testing @+op +voice plain",
+		":host.test 332 testing #ok :the topic",
+		":host.test 333 testing #ok setter!u@h 1500000000",
+		":host.test 324 testing #ok +ntk key",
+		":joiner!u@h JOIN #ok account :real name",
+		":op!u@h MODE #ok +o-v+b joiner voice *!*@bad",
+		":plain!u@h NICK renamed",
+		":op!u@h KICK #ok renamed :bye",
+		":op!u@h TOPIC #ok :new topic",
+		":voice!u@h QUIT :gone",
+	} {
+		c.trackChannels(Parse(line))
+	}
+	ch, ok := c.Channel("#OK")
+	if !ok {
+		t.Fatal("not in channel")
+	}
+	var nicks []string
+	for _, m := range c.Members("#ok") {
+		nicks = append(nicks, m.Prefixes+m.Nick)
+	}
+	if strings.Join(nicks, " ") != "@joiner @+op testing" {
+		t.Errorf("got members %q", nicks)
+	}
+	if m, _ := c.Member("#ok", "JOINER"); m.Account != "account" {
+		t.Errorf("got account %q", m.Account)
+	}
+	if !c.IsOp("#ok", "op") || c.IsOp("#ok", "testing") || !c.IsVoice("#ok", "joiner") {
+		t.Error("wrong op or voice")
+	}
+	if ch.Topic != "new topic" || ch.TopicBy != "op" {
+		t.Errorf("got topic %q by %q", ch.Topic, ch.TopicBy)
+	}
+	if ch.Modes["k"] != "key" || len(ch.Bans) != 1 || ch.Bans[0] != "*!*@bad" {
+		t.Errorf("got modes %q bans %q", ch.Modes, ch.Bans)
+	}
+	c.trackChannels(Parse(":testing!u@h PART #ok"))
+	if len(c.Channels()) != 0 {
+		t.Errorf("still in %q", c.Channels())
+	}
+}
@@ -3,13 +3,13 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
+	diamond "github.com/aerth/diamond/lib"
 	"github.com/aerth/ircb"
 )
 
@@ -27,39 +27,54 @@ var (
 	flagdisablemacros = flag.Bool("nodefine", false, "dont use definition system")
 	flagdisablekarma  = flag.Bool("nokarma", false, "dont use karma system")
 	verbose           = flag.Bool("v", false, "lots of extra printing")
+	flagdocs          = flag.Bool("docs", false, "print the command reference as markdown, and exit")
+	flagconfig        = flag.String("config", "", "config file, json, toml or yaml (default: config.json, config.toml, config.yaml or config.yml)")
 )
 
 func main() {
 	flag.Parse()
+	if *flagdocs {
+		prefix := "@"
+		if i := strings.Index(*flagmaster, ":"); i != -1 {
+			prefix = (*flagmaster)[i+1:]
+		}
+		os.Stdout.Write(ircb.DefaultRegistry().Markdown(*flagcommandprefix, prefix))
+		return
+	}
 
-LoadConfig:
+	filename := findConfig()
 	config := buildconfig()
-	b, err := ioutil.ReadFile("config.json")
-	if err == nil {
-		if len(b) != 0 {
-			err = json.Unmarshal(b, &config)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	} else if strings.Contains(err.Error(), "no such") {
-		_, err = os.Create("config.json")
+	b, err := ircb.ReadConfigFile(filename)
+	if os.IsNotExist(err) && *flagconfig == "" {
+		_, err = os.Create(filename)
 		if err != nil {
 			log.Fatalln("cant create config.json:", err)
 		}
-		goto LoadConfig
-
+		b = []byte("{}")
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		log.Fatal(err)
 	}
 	if *verbose {
 		config.Verbose = *verbose
 	}
+	if bot := loadBot(b, filename); bot != nil {
+		runBot(bot)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
 	conn := config.NewConnection()
+	conn.ConfigFile = filename
 	err = ircb.LoadPlugin(conn, "plugin.so")
 	if err != nil && err != ircb.ErrNoPluginSupport && err != ircb.ErrNoPlugin {
 		log.Fatal(err)
 	}
 
-	go catchSignals(conn)
+	go catchSignals(conn.Log, conn.Diamond, conn.Reload)
 
 	err = conn.Connect()
 	if err != nil {
@@ -95,14 +110,87 @@ func buildconfig() *ircb.Config {
 	return config
 }
 
-func catchSignals(c *ircb.Connection) {
+// findConfig returns the -config flag, or the first config file found
+func findConfig() string {
+	if *flagconfig != "" {
+		return *flagconfig
+	}
+	for _, name := range []string{"config.json", "config.toml", "config.yaml", "config.yml"} {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return "config.json"
+}
+
+// loadBot returns a bot if the config lists networks
+func loadBot(b []byte, filename string) *ircb.Bot {
+	var networks struct {
+		Networks []json.RawMessage
+	}
+	if len(b) == 0 || json.Unmarshal(b, &networks) != nil || len(networks.Networks) == 0 {
+		return nil
+	}
+	config, err := ircb.BotConfigFromJSON(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *verbose {
+		for _, network := range config.Networks {
+			network.Verbose = true
+		}
+	}
+	bot := config.NewBot()
+	bot.ConfigFile = filename
+	return bot
+}
+
+// runBot connects to all networks, and exits
+func runBot(bot *ircb.Bot) {
+	for _, name := range bot.Networks() {
+		err := ircb.LoadPlugin(bot.Network(name), "plugin.so")
+		if err != nil && err != ircb.ErrNoPluginSupport && err != ircb.ErrNoPlugin {
+			log.Fatal(err)
+		}
+	}
+
+	go catchSignals(bot.Log, bot.Diamond, bot.Reload)
+
+	err := bot.Connect()
+	if err != nil {
+		if strings.Contains(err.Error(), "delete if you want") {
+			os.Remove("diamond.socket")
+			err = bot.Connect()
+		}
+	}
+	bot.Log.Println(err)
+	os.Exit(111)
+}
+
+// catchSignals reloads the config on SIGHUP, and exits on the others
+func catchSignals(logger *log.Logger, getDiamond func() *diamond.System, reload func() ([]string, error)) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGQUIT, syscall.SIGHUP)
-	// Block until a signal is received.
-	s := <-ch
-	c.Log.Println("Got signal:", s)
-	if d := c.Diamond(); d != nil {
-		d.Runlevel(0)
+	for s := range ch {
+		logger.Println("Got signal:", s)
+		if s == syscall.SIGHUP {
+			// waits for the connection, while signals to exit still work
+			go func() {
+				changes, err := reload()
+				if err != nil {
+					logger.Println("reload error:", err)
+					return
+				}
+				logger.Printf("reloaded config, %v changes", len(changes))
+			}()
+			continue
+		}
+		if d := getDiamond(); d != nil {
+			d.Runlevel(0)
+		}
+		os.Exit(111)
 	}
-	os.Exit(111)
 }
@@ -2,10 +2,8 @@ package ircb
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
-	"sort"
 	"strings"
 	"time"
 )
@@ -38,61 +36,130 @@ func nilcommand(c *Connection, irc *IRC) {
 	c.Log.Println("nil command ran successfully")
 }
 
-// AddMasterCommand adds a new master command, named 'name' to the MasterMap
-func (c *Connection) AddMasterCommand(name string, fn Command) {
+// AddMasterCommand adds a new master command, named 'name' to the MasterMap, wrapped with any middleware
+func (c *Connection) AddMasterCommand(name string, fn Command, mw ...Middleware) {
 	c.maplock.Lock()
 	defer c.maplock.Unlock()
-	c.MasterMap[name] = fn
+	c.MasterMap[name] = Chain(fn, mw...)
 	return
 }
 
-// AddCommand adds a new public command, named 'name' to the CommandMap
-func (c *Connection) AddCommand(name string, fn Command) {
+// AddCommand adds a new public command, named 'name' to the CommandMap, wrapped with any middleware
+func (c *Connection) AddCommand(name string, fn Command, mw ...Middleware) {
 	c.maplock.Lock()
 	defer c.maplock.Unlock()
-	c.CommandMap[name] = fn
+	c.CommandMap[name] = Chain(fn, mw...)
 }
 
-// RemoveMasterCommand adds a new public command, named 'name' to the CommandMap
+// RemoveMasterCommand removes a master command, named 'name' (or an alias) from the MasterMap, with its aliases
 func (c *Connection) RemoveMasterCommand(name string) {
 	c.maplock.Lock()
 	defer c.maplock.Unlock()
 	delete(c.MasterMap, name)
+	for _, name := range c.registry.remove(name, true) {
+		delete(c.MasterMap, name)
+	}
 }
 
-// RemoveCommand removes a public command, named 'name' to the CommandMap
+// RemoveCommand removes a public command, named 'name' (or an alias) from the CommandMap, with its aliases
 func (c *Connection) RemoveCommand(name string) {
 	c.maplock.Lock()
 	defer c.maplock.Unlock()
 	delete(c.CommandMap, name)
+	for _, name := range c.registry.remove(name, false) {
+		delete(c.CommandMap, name)
+	}
+}
+
+// DefaultCommands returns the documented default commands, public and master
+func DefaultCommands() []CommandSpec {
+	return []CommandSpec{
+		// public
+		{Name: "quiet", Category: "general", Role: RoleOperator, Fn: commandQuiet, MaxArgs: 1,
+			Summary: "stop talking in this channel, for a while or until quiet again", Usage: "[duration|off]",
+			Examples: []string{"30m", "off"}},
+		{Name: "up", Aliases: []string{"uptime"}, Category: "general", Fn: commandUptime,
+			Summary: "how long the bot has been connected"},
+		{Name: "help", Category: "general", Fn: commandHelp, MaxArgs: 1,
+			Summary: "list commands, or show help for one", Usage: "[command]", Examples: []string{"karma"}},
+		{Name: "about", Category: "general", Fn: commandAbout,
+			Summary: "where to learn more about the bot"},
+		{Name: "karma", Category: "karma", Fn: commandKarma, Middleware: []Middleware{Feature("karma")},
+			Summary: "show karma, your own or someone else's, the leaderboard, or recent reasons (nick++ # reason, and nick-- to change it)",
+			Usage:   "[nick] | top|bottom [n] | rank|why|global [nick]", Examples: []string{"aerth", "top", "rank aerth", "why aerth", "global aerth"}},
+		{Name: "define", Category: "define", Fn: commandDefine, Middleware: []Middleware{Feature("define")}, MinArgs: 2,
+			Summary: "define a word, then the word as a command replies with the text (admins can lock a word)",
+			Usage:   "<word> <text> | lock|unlock <word>", Examples: []string{"ircb a bot that lives on irc", "lock ircb"}},
+		{Name: "undefine", Category: "define", Fn: commandUndefine, Middleware: []Middleware{Feature("define")}, MinArgs: 1, MaxArgs: 1,
+			Summary: "remove a definition, it can be restored with factoid revert", Usage: "<word>", Examples: []string{"ircb"}},
+		{Name: "factoid", Category: "define", Fn: commandFactoid, Middleware: []Middleware{Feature("define")}, MinArgs: 2,
+			Summary:  "show a definition and who wrote it, its revisions, restore an old one, or search words and text",
+			Usage:    "show|history <word> | revert <word> <rev> | search <text|/regex/>",
+			Examples: []string{"show ircb", "history ircb", "revert ircb 2", "search bot", "search /^go/"}},
+
+		// master
+		{Name: "do", Master: true, Category: "admin", Role: RoleOwner, Fn: commandMasterDo, MinArgs: 1,
+			Summary: "send a raw irc line", Usage: "<line>", Examples: []string{"JOIN ##ircb"}},
+		{Name: "upgrade", Master: true, Category: "admin", Role: RoleOwner, Fn: commandMasterUpgrade,
+			Summary: "pull the latest source, rebuild and respawn"},
+		{Name: "reboot", Aliases: []string{"r"}, Master: true, Category: "admin", Role: RoleOwner, Fn: commandMasterReboot,
+			Summary: "save the config and respawn"},
+		{Name: "part", Master: true, Category: "admin", Fn: commandMasterPart, MaxArgs: 1,
+			Summary: "leave this channel, or the named one", Usage: "[channel]"},
+		{Name: "echo", Master: true, Category: "admin", Fn: commandEcho,
+			Summary: "say something", Usage: "<text>"},
+		{Name: "quit", Aliases: []string{"q"}, Master: true, Category: "admin", Fn: commandMasterQuit, Hidden: true},
+		{Name: "help", Master: true, Category: "admin", Fn: commandMasterHelp, MaxArgs: 1,
+			Summary: "list master commands, or show help for one", Usage: "[command]", Examples: []string{"set"}},
+		{Name: "set", Master: true, Category: "admin", Fn: commandMasterSet, MinArgs: 2, MaxArgs: 2,
+			Summary: "turn a feature on or off for this network", Usage: "<links|define|karma> <on|off>", Examples: []string{"karma off"}},
+		{Name: "channel", Master: true, Category: "admin", Fn: commandMasterChannel,
+			Summary:  "show or change a channel's settings (prefix, karma, define, links, muted, language, maxlines), 'default' uses the network's",
+			Usage:    "[#channel] [setting] [value|default]",
+			Examples: []string{"#ircb", "#ircb karma off", "#ircb prefix .", "#ircb maxlines 3", "#ircb karma default"}},
+		{Name: "role", Master: true, Category: "admin", Fn: commandMasterRole, MinArgs: 1,
+			Summary: "grant and revoke roles (user, trusted, operator, admin, owner), or change the role a command needs",
+			Usage:   "grant <role> <mask> [channel] | revoke <mask> [channel] | list [channel] | command <name> <role|default>",
+			Examples: []string{"grant admin account:aerth", "grant operator *!*@example.com #ircb", "grant trusted certfp:0123abcd",
+				"command define trusted"}},
+		{Name: "reload", Master: true, Category: "admin", Role: RoleOwner, Fn: commandMasterReload,
+			Summary: "read the config file again, joining and parting channels (some options need a reconnect or restart)"},
+		{Name: "config", Master: true, Category: "admin", Fn: commandMasterConfig, MinArgs: 1, MaxArgs: 1,
+			Summary: "show how the running config differs from the config file, or save it (changes are saved as they are made)",
+			Usage:   "<diff|save>", Examples: []string{"diff"}},
+		{Name: "karma", Master: true, Category: "karma", Fn: commandMasterKarma, MinArgs: 1, MaxArgs: 3,
+			Summary: "send karma for one nick to another name (or services account), or merge names that only differ in case",
+			Usage:   "alias <nick> <name> | unalias <nick> | aliases | migrate", Examples: []string{"alias aerth_ aerth", "migrate"}},
+		{Name: "queue", Master: true, Category: "admin", Fn: commandMasterQueue,
+			Summary: "show send queue stats"},
+		{Name: "plugin", Master: true, Category: "plugins", Role: RoleOwner, Fn: masterCommandLoadPlugin, MinArgs: 1, MaxArgs: 1,
+			Summary: "load a compiled plugin", Usage: "<name>", Examples: []string{"skeleton"}},
+		{Name: "fetch", Master: true, Category: "plugins", Role: RoleOwner, Fn: masterCommandFetchPlugin, MinArgs: 1, MaxArgs: 1,
+			Summary: "fetch, build and load a plugin from github.com/aerth/ircb-plugins", Usage: "<name>", Examples: []string{"skeleton"}},
+	}
 }
 
 // DefaultCommandMap returns default command map
 func DefaultCommandMap() map[string]Command {
-	m := make(map[string]Command)
-	m["quiet"] = commandQuiet   // quiet
-	m["up"] = commandUptime     // bot uptime
-	m["help"] = commandHelp     // list commands
-	m["about"] = commandAbout   // about link
-	m["karma"] = commandKarma   // karma system
-	m["define"] = commandDefine // define system
-	return m
+	return defaultMap(false)
 }
 
 // DefaultMasterMap returns default master command map
 func DefaultMasterMap() map[string]Command {
+	return defaultMap(true)
+}
+
+func defaultMap(master bool) map[string]Command {
 	m := make(map[string]Command)
-	m["do"] = commandMasterDo             // do <raw irc>
-	m["upgrade"] = commandMasterUpgrade   // upgrade and redeploy
-	m["r"] = commandMasterReboot          // reboot
-	m["part"] = commandMasterPart         // part <channel>
-	m["echo"] = commandEcho               // echo back
-	m["quit"] = commandMasterQuit         // cant quit
-	m["q"] = commandMasterQuit            // cant quit
-	m["help"] = commandMasterHelp         // list master commands
-	m["set"] = commandMasterSet           // set (some) config options
-	m["plugin"] = masterCommandLoadPlugin // load a local .so
-	m["fetch"] = masterCommandFetchPlugin // fetch latest plugin from repo
+	for _, spec := range DefaultCommands() {
+		if spec.Master != master {
+			continue
+		}
+		fn := spec.Command()
+		for _, name := range append([]string{spec.Name}, spec.Aliases...) {
+			m[name] = fn
+		}
+	}
 	return m
 }
 
@@ -117,68 +184,54 @@ func commandHostUptime(c *Connection, irc *IRC) {
 func commandEcho(c *Connection, irc *IRC) {
 	irc.Reply(c, fmt.Sprint(strings.Join(irc.Arguments, " ")))
 }
+// commandQuiet mutes the channel, for a while if given a duration such as '30m', or unmutes it
 func commandQuiet(c *Connection, irc *IRC) {
-	c.quiet = !c.quiet
-	if !c.quiet {
-		c.Log.Println("no longer quiet")
-		irc.Reply(c, "\x01ACTION gasps for air\x01")
+	if !c.IsChannel(irc.To) {
+		irc.Reply(c, "quiet works in channels")
+		return
 	}
-	c.Log.Println("muted")
-}
-func commandMasterHelp(c *Connection, irc *IRC) {
-	if len(irc.Arguments) < 2 || irc.Arguments[0] == "" {
-		var list []string
-		for i := range c.MasterMap {
-			list = append(list, i)
+	if len(irc.Arguments) == 0 && c.Settings(irc.To).Muted || len(irc.Arguments) == 1 && irc.Arguments[0] == "off" {
+		if err := c.Unmute(irc.To); err != nil {
+			c.Log.Println("unmute error:", err)
+			return
 		}
-		sort.Strings(list)
-		irc.Reply(c, fmt.Sprintf("%v master commands: %s", len(list), list))
+		c.Log.Printf("no longer quiet in %s", irc.To)
+		irc.Reply(c, "\x01ACTION gasps for air\x01")
 		return
 	}
-
-}
-func commandHelp(c *Connection, irc *IRC) {
-	if len(irc.Arguments) < 2 || irc.Arguments[0] == "" {
-		var list []string
-		for i := range c.CommandMap {
-			list = append(list, i)
+	var d time.Duration
+	if len(irc.Arguments) == 1 {
+		var err error
+		d, err = time.ParseDuration(irc.Arguments[0])
+		if err != nil || d <= 0 {
+			irc.Reply(c, "usage: "+c.commandPrefix(irc, false)+"quiet [duration|off], such as 30m")
+			return
 		}
-		sort.Strings(list)
-		irc.Reply(c, fmt.Sprintf("%v commands: %s", len(list), list))
+	}
+	if err := c.Mute(irc.To, d); err != nil {
+		c.Log.Println("mute error:", err)
+		irc.ReplyUser(c, "error, check logs")
 		return
 	}
+	c.Log.Printf("muted in %s by %s for %v", irc.To, irc.Nick, d)
+}
+func commandMasterHelp(c *Connection, irc *IRC) {
+	c.help(irc, true)
+}
+func commandHelp(c *Connection, irc *IRC) {
+	c.help(irc, false)
 }
 
 func commandAbout(c *Connection, irc *IRC) {
 	irc.Reply(c, "I'm a robot. You can learn more at https://aerth.github.io/ircb/")
 }
 func commandLineCount(c *Connection, irc *IRC) {}
-func commandDefine(c *Connection, irc *IRC) {
-	if !c.config.Define {
-		return
-	}
-	if len(irc.Arguments) < 2 || irc.Arguments[0] == "" {
-		irc.Reply(c, "usage: define [word] [text]")
-		return
-	}
-	action := irc.Arguments[0]
-	if _, ok := c.CommandMap[action]; ok {
-		irc.Reply(c, fmt.Sprintf("already defined as command: %q", action))
-		return
-	}
-	definition := strings.Join(irc.Arguments[1:], " ")
-
-	c.databaseDefine(action, definition)
-	irc.Reply(c, fmt.Sprintf("defined: %q", action))
-
-}
 func commandMasterDo(c *Connection, irc *IRC) {
 	c.Log.Println("GOT DO:", irc)
 	c.Write([]byte(strings.Join(irc.Arguments, " ")))
 }
 func commandMasterReboot(c *Connection, irc *IRC) {
-	b := c.MarshalConfig()
-	err := ioutil.WriteFile("config.json", b, 0600)
+	err := c.SaveConfig()
 	if err != nil {
 		c.Log.Printf("error while trying to write config file for respawn: %v", err)
 		irc.Reply(c, "cant reboot, check logs")
@@ -194,12 +247,12 @@ func commandMasterQuit(c *Connection, irc *IRC) {
 
 func commandMasterPart(c *Connection, irc *IRC) {
 	part := func(ch string) []byte {
-		if strings.HasPrefix(ch, "#") {
+		if c.IsChannel(ch) {
 			return []byte("PART :" + ch)
 		}
 		return nil
 	}
-	if strings.HasPrefix(irc.To, "#") {
+	if c.IsChannel(irc.To) {
 		irc.Reply(c, ":(")
 		c.Write(part(irc.To))
 		c.SendMaster("Parted channel: %q", irc.To)
@@ -212,21 +265,32 @@ func commandMasterPart(c *Connection, irc *IRC) {
 
 }
 
+func commandMasterPrefix(c *Connection, irc *IRC) {
+	c.config.CommandPrefix = irc.Arguments[0]
+	c.Log.Printf("**New command prefix: %q", c.config.CommandPrefix)
+	c.SendMaster("**New command prefix: %q", c.config.CommandPrefix)
+	c.saveConfig("CommandPrefix")
+}
+
+func commandMasterQueue(c *Connection, irc *IRC) {
+	stats := c.QueueStats()
+	irc.Reply(c, fmt.Sprintf("queued: %v (%v targets), sent: %v, dropped: %v",
+		stats.Depth, stats.Targets, stats.Sent, stats.Dropped))
+}
+
 func commandMasterDebug(c *Connection, irc *IRC) {
 	c.Log.Println(c, irc)
 }
 func commandMasterSet(c *Connection, irc *IRC) {
-	if len(irc.Arguments) != 2 {
-		irc.Reply(c, `usage: set optionname on|off`)
-		return
-	}
 	option := irc.Arguments[0]
 	value := irc.Arguments[1]
+	var field string
 	switch option {
 	default:
 		irc.Reply(c, `no option like that, 'links' 'define' or 'karma'`)
 		return
 	case "links":
+		field = "ParseLinks"
 		switch value {
 		case "on":
 			c.config.ParseLinks = true
@@ -237,6 +301,7 @@ func commandMasterSet(c *Connection, irc *IRC) {
 			return
 		}
 	case "define":
+		field = "Define"
 		switch value {
 		case "on":
 			c.config.Define = true
@@ -248,6 +313,7 @@ func commandMasterSet(c *Connection, irc *IRC) {
 		}
 
 	case "karma":
+		field = "Karma"
 		switch value {
 		case "on":
 			c.config.Karma = true
@@ -259,6 +325,7 @@ func commandMasterSet(c *Connection, irc *IRC) {
 		}
 
 	}
+	c.saveConfig(field)
 }
 func commandMasterUpgrade(c *Connection, irc *IRC) {
 	checkout := exec.Command("git", "checkout", "master")
@@ -295,10 +362,6 @@ func commandMasterUpgrade(c *Connection, irc *IRC) {
 
 }
 func masterCommandLoadPlugin(c *Connection, irc *IRC) {
-	if len(irc.Arguments) != 1 {
-		irc.Reply(c, "need plugin name")
-		return
-	}
 	name := strings.TrimSpace(irc.Arguments[0])
 	err := LoadPlugin(c, name)
 	if err != nil {
@@ -310,10 +373,6 @@ func masterCommandLoadPlugin(c *Connection, irc *IRC) {
 
 func masterCommandFetchPlugin(c *Connection, irc *IRC) {
 	os.Setenv("CGO_ENABLED", "1")
-	if irc.Arguments == nil || len(irc.Arguments) != 1 {
-		irc.Reply(c, Red+"need plugin name")
-		return
-	}
 	name := irc.Arguments[0]
 	if strings.TrimSpace(name) == "" || strings.Contains(name, "..") {
 		return
@@ -348,52 +407,39 @@ func masterCommandFetchPlugin(c *Connection, irc *IRC) {
 
 }
 
-func commandKarma(c *Connection, irc *IRC) {
-	if !c.config.Karma {
-		irc.ReplyUser(c, "karma is disabled")
-		return
-	}
-	if len(irc.Arguments) != 1 {
-		irc.Reply(c, c.karmaShow(irc.ReplyTo))
-		return
-	}
-
-	irc.Reply(c, c.karmaShow(irc.Arguments[0]))
-}
-func (c *Connection) parseKarma(input string) bool {
-	if !c.config.Karma {
-		return nothandled
-	}
-	split := strings.Split(input, " ")
-	if len(split) < 1 {
+// parseKarma changes karma for each 'nick++', 'nick--', '(some thing)++' or 'nick: thanks' in a message (see karmaOps),
+// with an optional '# reason'
+func (c *Connection) parseKarma(irc *IRC) bool {
+	if irc.IsCommand {
 		return nothandled
 	}
-
-	// input is more than one word, try "thank" method
-	if len(split) > 1 {
-		if strings.Contains(input, "thank") {
-			if i := strings.Index(input, ":"); i != -1 && i != 0 {
-				c.Log.Println("Karma:", input[0:i])
-				c.karmaUp(input[0:i])
-				return handled
-			}
-			return nothandled
+	input, reason := karmaReason(irc.Message)
+	add := func(name string, delta int) {
+		e := KarmaEvent{From: irc.Nick, Giver: c.KarmaName(irc.Nick), To: c.KarmaName(name), Channel: irc.To, Delta: delta, Reason: reason}
+		switch err := c.addKarma(e); err {
+		case nil:
+		case ErrSelfKarma, ErrKarmaCap:
+			irc.ReplyUser(c, err.Error())
+		case ErrKarmaCooldown:
+			c.Log.Printf("karma from %s to %s: %v", irc.Nick, e.To, err)
+		default:
+			c.Log.Println("karma error:", err)
 		}
-		return nothandled
 	}
-
-	// user+
-	if strings.HasSuffix(input, "+") {
-		c.karmaUp(strings.Replace(input, "+", "", -1))
-		return handled
+	ops := karmaOps(input, c.config.KarmaIgnore)
+	if len(ops) == 0 {
+		return nothandled
 	}
-
-	// user-
-	if strings.HasSuffix(input, "-") {
-		c.karmaDown(strings.Replace(input, "-", "", -1))
-		return handled
+	// once per name in a message
+	seen := make(map[string]bool)
+	for _, op := range ops {
+		key := c.KarmaName(op.Name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		c.Log.Printf("karma: %s %+d from %s", op.Name, op.Delta, irc.Nick)
+		add(op.Name, op.Delta)
 	}
-
-	// no karma found
-	return nothandled
+	return handled
 }
@@ -6,6 +6,7 @@ import (
 
 // Config holds configurable variables for ircb client
 type Config struct {
+	Network       string // network name, when running in a Bot
 	Host          string // in the form 'host:port'
 	Nick          string
 	Master        string // in the form 'master:prefix'
@@ -17,10 +18,31 @@ type Config struct {
 	Define        bool
 	Verbose       bool
 	Karma         bool
-	Diamond       bool   // use diamond system
-	DiamondSocket string // path to socket
-	Database      string // path to boltdb (can be empty to use bolt.db)
-	AuthMode      int    // 0 ACC (freenode, recommended), 1 STATUS, -1 none
+	Diamond       bool     // use diamond system
+	DiamondSocket string   // path to socket
+	Database      string   // path to boltdb (can be empty to use bolt.db)
+	AuthMode      int      // NickServ check when the server shows no account: 0 ACC (freenode, recommended), 1 STATUS, -1 none
+	Capabilities  []string // IRCv3 capabilities to request, if available
+	SASL          string   // SASL mechanism, 'PLAIN' or 'EXTERNAL' (can be empty for none)
+	SASLUser      string   // SASL PLAIN account name (can be empty to use Nick)
+	SASLPass      string   // SASL PLAIN password
+	TLSCert       string   // path to TLS client certificate, for SASL EXTERNAL
+	TLSKey        string   // path to TLS client certificate key
+	Reconnect     int      // reconnect attempts in a row before giving up, 0 for no limit, -1 to never reconnect
+	ReconnectWait int      // max seconds to wait between reconnect attempts (can be 0 to use 300)
+	FloodRate     float64  // lines per second sent after FloodBurst, 0 for default (0.5), -1 for no limit
+	FloodBurst    int      // lines that can be sent at once (can be 0 to use 5)
+	FloodQueue    int      // max lines waiting per channel or user, and of other lines, more are dropped (can be 0 to use 50)
+	AltNicks      []string // nicks to use when Nick is taken, then Nick_, Nick__, Nick1...
+	NickRegain    int      // seconds between tries to regain Nick, 0 for default (60), -1 to never try
+	NickPassword  string   // NickServ password, to regain Nick with RegainCommand (can be empty)
+	RegainCommand string   // NickServ command to regain Nick, 'REGAIN' (default) or 'GHOST'
+	Language      string   // for plugins, such as 'en' (can be empty), channels can have their own, see Connection.Settings
+	MaxLines      int      // max lines sent to a channel for one message, 0 for no limit
+	KarmaCooldown int      // seconds between karma from one nick to another, 0 for default (60), -1 for none
+	KarmaDailyCap int      // karma one nick can give in a day, 0 for default (30), -1 for no limit
+	KarmaAccounts bool     // karma for a logged in nick goes to their services account
+	KarmaIgnore   []string // words that are not karma, such as 'c' in 'c++', see DefaultKarmaIgnore
 }
 
 // NewDefaultConfig returns the default config, minimal changes would be Host,Nick,Master for typical usage.
@@ -36,12 +58,19 @@ func NewDefaultConfig() *Config {
 	config.Karma = true
 	config.ParseLinks = false
 	config.Define = true
+	config.Capabilities = append([]string(nil), DefaultCapabilities...)
+	config.KarmaIgnore = append([]string(nil), DefaultKarmaIgnore...)
 	return config
 }
 
 // MarshalConfig encodes the connection's config as JSON
+// If the bot is using an alternate nick, the primary nick is saved.
 func (c *Connection) MarshalConfig() []byte {
-	b, _ := c.config.Marshal()
+	config := *c.config
+	if c.nick != "" {
+		config.Nick = c.nick
+	}
+	b, _ := config.Marshal()
 	return b
 }
 
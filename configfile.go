@@ -0,0 +1,315 @@
+package ircb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReadConfigFile reads a JSON, TOML (.toml) or YAML (.yaml, .yml) config file, returning it as JSON,
+// for ConfigFromJSON or BotConfigFromJSON. Keys are the Config field names in any format.
+//
+// Any '${NAME}' in a string is replaced with the environment variable, for secrets:
+//
+//	SASLPass = "${IRCB_SASL_PASS}"
+func ReadConfigFile(filename string) ([]byte, error) {
+	tree, err := readConfigTree(filename)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	interpolate(tree, &missing)
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("%s: not set in environment: %s", filename, strings.Join(missing, ", "))
+	}
+	return json.Marshal(tree)
+}
+
+// readConfigTree decodes a config file, without interpolation. An empty file is an empty map.
+func readConfigTree(filename string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]interface{})
+	if len(bytes.TrimSpace(b)) == 0 {
+		return tree, nil
+	}
+	switch configFormat(filename) {
+	case "toml":
+		_, err = toml.Decode(string(b), &tree)
+	case "yaml":
+		var v interface{}
+		if err = yaml.Unmarshal(b, &v); err == nil {
+			m, ok := fromYAML(v).(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: not a map of options", filename)
+			}
+			tree = m
+		}
+	default:
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		err = d.Decode(&tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return tree, nil
+}
+
+// configFormat returns 'json', 'toml' or 'yaml', by file extension
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		return "toml"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+// LoadConfig reads and validates a config file, see ReadConfigFile
+func LoadConfig(filename string) (*Config, error) {
+	b, err := ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ConfigFromJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return config, config.Validate()
+}
+
+// LoadBotConfig reads and validates a bot config file, see ReadConfigFile
+func LoadBotConfig(filename string) (*BotConfig, error) {
+	b, err := ReadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := BotConfigFromJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return bc, bc.Validate()
+}
+
+// fromYAML changes yaml's map keys to strings, for encoding/json
+func fromYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = fromYAML(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = fromYAML(v[i])
+		}
+	}
+	return v
+}
+
+var envpattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolate replaces '${NAME}' in strings with environment variables, adding unset names to missing
+func interpolate(v interface{}, missing *[]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return envpattern.ReplaceAllStringFunc(v, func(s string) string {
+			name := envpattern.FindStringSubmatch(s)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*missing = append(*missing, name)
+			}
+			return value
+		})
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = interpolate(v[k], missing)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = interpolate(v[i], missing)
+		}
+	}
+	return v
+}
+
+// ConfigErrors lists everything wrong with a config, see Config.Validate
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	var lines []string
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	if len(lines) == 1 {
+		return "config: " + lines[0]
+	}
+	return fmt.Sprintf("config: %v errors:\n  %s", len(lines), strings.Join(lines, "\n  "))
+}
+
+// Validate returns ConfigErrors with all problems found, or nil
+func (c Config) Validate() error {
+	var errs ConfigErrors
+	add := func(format string, i ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, i...))
+	}
+	if host, port, err := net.SplitHostPort(c.Host); err != nil || host == "" {
+		add("Host: %q should be 'host:port'", c.Host)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		add("Host: bad port %q", port)
+	}
+	if !validNick(c.Nick) {
+		add("Nick: %q is not a valid nick", c.Nick)
+	}
+	for _, nick := range c.AltNicks {
+		if !validNick(nick) {
+			add("AltNicks: %q is not a valid nick", nick)
+		}
+	}
+	if i := strings.Index(c.Master, ":"); i == -1 {
+		add("Master: %q should be 'nick:prefix', such as 'aerth:$'", c.Master)
+	} else if !validNick(c.Master[:i]) {
+		add("Master: %q is not a valid nick", c.Master[:i])
+	} else if strings.TrimSpace(c.Master[i+1:]) == "" {
+		add("Master: %q needs a command prefix after ':'", c.Master)
+	}
+	if strings.TrimSpace(c.CommandPrefix) == "" {
+		add("CommandPrefix: can not be empty")
+	}
+	for _, ch := range strings.Split(c.Channels, ",") {
+		ch = strings.TrimSpace(ch)
+		if ch != "" && (!strings.ContainsAny(ch[:1], defaultChanTypes+"!+") || strings.ContainsAny(ch, " \a")) {
+			add("Channels: %q is not a channel", ch)
+		}
+	}
+	switch strings.ToUpper(c.SASL) {
+	case "":
+	case "PLAIN":
+		if c.SASLPass == "" {
+			add("SASLPass: needed for SASL PLAIN")
+		}
+	case "EXTERNAL":
+		if c.TLSCert == "" {
+			add("TLSCert: needed for SASL EXTERNAL")
+		}
+		if !c.UseSSL {
+			add("UseSSL: needed for SASL EXTERNAL")
+		}
+	default:
+		add("SASL: %q should be 'PLAIN', 'EXTERNAL' or empty", c.SASL)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		add("TLSCert, TLSKey: need both or neither")
+	}
+	if c.AuthMode < -1 || c.AuthMode > 1 {
+		add("AuthMode: %v should be 0, 1 or -1", c.AuthMode)
+	}
+	switch strings.ToUpper(c.RegainCommand) {
+	case "", "REGAIN", "GHOST":
+	default:
+		add("RegainCommand: %q should be 'REGAIN' or 'GHOST'", c.RegainCommand)
+	}
+	for _, v := range []struct {
+		name   string
+		n, min int
+	}{
+		{"Reconnect", c.Reconnect, -1},
+		{"ReconnectWait", c.ReconnectWait, 0},
+		{"FloodBurst", c.FloodBurst, 0},
+		{"FloodQueue", c.FloodQueue, 0},
+		{"NickRegain", c.NickRegain, -1},
+		{"MaxLines", c.MaxLines, 0},
+		{"KarmaCooldown", c.KarmaCooldown, -1},
+		{"KarmaDailyCap", c.KarmaDailyCap, -1},
+	} {
+		if v.n < v.min {
+			add("%s: %v is less than %v", v.name, v.n, v.min)
+		}
+	}
+	if c.FloodRate < 0 && c.FloodRate != -1 {
+		add("FloodRate: %v should be -1 for no limit, or more than 0", c.FloodRate)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Validate checks every network, see Config.Validate
+func (bc BotConfig) Validate() error {
+	if len(bc.Networks) == 0 {
+		return bc.Config.Validate()
+	}
+	var errs ConfigErrors
+	for _, config := range bc.Networks {
+		if err := config.Validate(); err != nil {
+			for _, err := range err.(ConfigErrors) {
+				errs = append(errs, fmt.Errorf("network %q: %v", config.Network, err))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validNick returns true if nick could be a nick
+func validNick(nick string) bool {
+	if nick == "" || strings.ContainsAny(nick, " ,*?!@.:#&") {
+		return false
+	}
+	return !strings.ContainsAny(nick[:1], "0123456789-$")
+}
+
+// secret config fields, not shown in logs or replies
+var secretFields = map[string]bool{"SASLPass": true, "NickPassword": true}
+
+// redacted returns a copy of the config without secrets, for printing
+func (c Config) redacted() Config {
+	if c.SASLPass != "" {
+		c.SASLPass = "********"
+	}
+	if c.NickPassword != "" {
+		c.NickPassword = "********"
+	}
+	return c
+}
+
+// configChanges lists the fields that differ, as 'Field: old -> new' or just 'Field changed' for secrets
+func configChanges(old, new Config) []string {
+	var a, b map[string]json.RawMessage
+	oldjson, _ := json.Marshal(old)
+	newjson, _ := json.Marshal(new)
+	json.Unmarshal(oldjson, &a)
+	json.Unmarshal(newjson, &b)
+	var changes []string
+	for k, v := range b {
+		if string(a[k]) == string(v) {
+			continue
+		}
+		if secretFields[k] {
+			changes = append(changes, k+" changed")
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", k, a[k], v))
+	}
+	sort.Strings(changes)
+	return changes
+}
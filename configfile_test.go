@@ -0,0 +1,161 @@
+package ircb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("IRCB_TEST_PASS", "hunter2")
+	defer os.Unsetenv("IRCB_TEST_PASS")
+
+	files := map[string]string{
+		"config.json": `{"Host": "irc.example.com:6697", "Nick": "sally", "Master": "aerth:$", "SASLPass": "${IRCB_TEST_PASS}", "FloodBurst": 3, "AltNicks": ["sal"]}`,
+		"config.toml": "Host = \"irc.example.com:6697\"\nNick = \"sally\"\nMaster = \"aerth:$\"\nSASLPass = \"${IRCB_TEST_PASS}\"\nFloodBurst = 3\nAltNicks = [\"sal\"]\n",
+		"config.yaml": "host: irc.example.com:6697\nnick: sally\nmaster: aerth:$\nsaslpass: ${IRCB_TEST_PASS}\nfloodburst: 3\naltnicks: [sal]\n",
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfig(filename)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if config.Host != "irc.example.com:6697" || config.Nick != "sally" || config.Master != "aerth:$" ||
+			config.SASLPass != "hunter2" || config.FloodBurst != 3 || len(config.AltNicks) != 1 || !config.Karma {
+			t.Errorf("%s: got %+v", name, config)
+		}
+	}
+
+	filename := filepath.Join(dir, "missing.json")
+	ioutil.WriteFile(filename, []byte(`{"SASLPass": "${IRCB_TEST_UNSET}"}`), 0600)
+	if _, err := ReadConfigFile(filename); err == nil || !strings.Contains(err.Error(), "IRCB_TEST_UNSET") {
+		t.Errorf("expected error for unset variable, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := NewDefaultConfig().Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	config := NewDefaultConfig()
+	config.Master = "aerth"
+	config.Host = "chat.freenode.net"
+	config.Channels = "##ircb,ircb"
+	config.SASL = "PLAIN"
+	config.MaxLines = -1
+	err := config.Validate()
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 5 {
+		t.Fatalf("expected 5 errors, got %v", err)
+	}
+	for _, field := range []string{"Master", "Host", "Channels", "SASLPass", "MaxLines"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("expected %s error, got %v", field, err)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	c := NewTestConnection()
+	config := *testconfig
+	config.Channels = "#one,#two"
+	c.config = &config
+	c.nick = config.Nick
+	c.queue = newSendQueue(c.config)
+	c.joined = true
+
+	next := config
+	next.Channels = "#two,#three"
+	next.Karma = true
+	next.NickPassword = "secret"
+	next.Host = "irc.example.com:6667"
+	changes := c.ApplyConfig(&next)
+	out := c.conn.(*testconnection).buf.String()
+	if !strings.Contains(out, "JOIN #three") || !strings.Contains(out, "PART #one") || strings.Contains(out, "#two") {
+		t.Errorf("expected join #three and part #one, got %q", out)
+	}
+	got := strings.Join(changes, "\n")
+	for _, expected := range []string{"Karma: false -> true", "NickPassword changed", "(on reconnect)"} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("expected %q in changes, got %q", expected, got)
+		}
+	}
+	if strings.Contains(got, "secret") {
+		t.Errorf("secret in changes: %q", got)
+	}
+	if !c.config.Karma || c.config.Channels != "#two,#three" {
+		t.Errorf("config not applied: %+v", c.config)
+	}
+}
+
+// run with -race: reloading (as on SIGHUP) while the connection handles lines
+func TestReloadWhileReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the log file
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	client, server := net.Pipe()
+	c := NewTestConnection()
+	c.conn = client
+	c.reader = bufio.NewReader(client)
+	c.queue = newSendQueue(c.config)
+	c.nick = c.config.Nick
+	c.joined = true
+	c.done = make(chan struct{})
+	c.tasks = make(chan func())
+	c.On("PRIVMSG", commandHandler)
+	c.ConfigFile = filepath.Join(dir, "config.json")
+	go io.Copy(ioutil.Discard, server)
+	stopped := make(chan error)
+	go func() { stopped <- c.readerwriter() }()
+	// keep the reader busy until the reloads are done
+	quit := make(chan struct{})
+	go func() {
+		defer server.Close()
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			fmt.Fprintf(server, ":alice!u@h PRIVMSG #chan :hello %v\r\nPING :%v\r\n:testing!u@h NICK testing\r\n", i, i)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		config := fmt.Sprintf(`{"Host": "irc.example.com:6667", "Nick": "sally%v", "Master": "aerth:$", "Karma": %v, "FloodBurst": %v}`, i, i%2 == 0, i+1)
+		if err := ioutil.WriteFile(c.ConfigFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(quit)
+	<-stopped
+	if c.nick != "sally19" {
+		t.Errorf("expected last nick, got %q", c.nick)
+	}
+}
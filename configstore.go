@@ -0,0 +1,377 @@
+package ircb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configBackups is how many old config files are kept, as config.json.1 (newest) to config.json.3
+const configBackups = 3
+
+// configFileLock guards writing config files
+var configFileLock sync.Mutex
+
+// configDiff is an option that differs between the config file and the running config
+type configDiff struct {
+	Network string // empty for the global options
+	Field   string
+	File    json.RawMessage
+	Running json.RawMessage
+}
+
+func (d configDiff) String() string {
+	s := fmt.Sprintf("%s: %s -> %s", d.Field, d.File, d.Running)
+	if secretFields[d.Field] {
+		s = d.Field + " changed"
+	}
+	if d.Network != "" {
+		s = "[" + d.Network + "] " + s
+	}
+	return s
+}
+
+// diffConfigs returns the options that differ, except those that can't change while running (see restartFields)
+func diffConfigs(network string, file, running Config) []configDiff {
+	var a, b map[string]json.RawMessage
+	filejson, _ := json.Marshal(file)
+	runningjson, _ := json.Marshal(running)
+	json.Unmarshal(filejson, &a)
+	json.Unmarshal(runningjson, &b)
+	skip := map[string]bool{"Verbose": true}
+	for _, k := range restartFields {
+		skip[k] = true
+	}
+	var diffs []configDiff
+	for k, v := range b {
+		if !skip[k] && string(a[k]) != string(v) {
+			diffs = append(diffs, configDiff{Network: network, Field: k, File: a[k], Running: v})
+		}
+	}
+	sort.Sort(byField(diffs))
+	return diffs
+}
+
+type byField []configDiff
+
+func (s byField) Len() int      { return len(s) }
+func (s byField) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byField) Less(i, j int) bool {
+	if s[i].Network != s[j].Network {
+		return s[i].Network < s[j].Network
+	}
+	return s[i].Field < s[j].Field
+}
+
+// readConfigJSON is ReadConfigFile, but a missing file is empty
+func readConfigJSON(filename string) ([]byte, error) {
+	b, err := ReadConfigFile(filename)
+	if os.IsNotExist(err) {
+		return []byte("{}"), nil
+	}
+	return b, err
+}
+
+// configDiffs compares the running config with the config file
+func (c *Connection) configDiffs() ([]configDiff, error) {
+	if c.bot != nil {
+		return c.bot.configDiffs()
+	}
+	b, err := readConfigJSON(configFile(c.ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	file, err := ConfigFromJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	running := *c.config
+	running.Nick = c.nick
+	return diffConfigs("", *file, running), nil
+}
+
+// configDiffs compares the running config of each network with the config file
+func (b *Bot) configDiffs() ([]configDiff, error) {
+	data, err := readConfigJSON(configFile(b.ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	bc, err := BotConfigFromJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	b.configlock.Lock()
+	diffs := diffConfigs("", bc.Config, b.config.Config)
+	b.configlock.Unlock()
+	for _, name := range b.Networks() {
+		c := b.networks[name]
+		file := bc.Config
+		for _, config := range bc.Networks {
+			if config.Network == name {
+				file = *config
+			}
+		}
+		running := *c.config
+		running.Nick = c.nick
+		diffs = append(diffs, diffConfigs(name, file, running)...)
+	}
+	return diffs, nil
+}
+
+// ConfigDiff lists how the running config differs from the config file, secrets are not shown
+func (c *Connection) ConfigDiff() ([]string, error) {
+	diffs, err := c.configDiffs()
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, d := range diffs {
+		list = append(list, d.String())
+	}
+	return list, nil
+}
+
+// SaveConfig writes runtime changes to the config file (see ConfigFile), keeping its format,
+// and other options as they are, such as '${NAME}' secrets.
+// The file is replaced atomically, and the old one is kept as a backup.
+// With fields, only those options of this connection are written, not options that came from flags.
+func (c *Connection) SaveConfig(fields ...string) error {
+	diffs, err := c.configDiffs()
+	if err != nil {
+		return err
+	}
+	if len(fields) != 0 {
+		var only []configDiff
+		for _, d := range diffs {
+			if d.Network == c.Network() && contains(fields, d.Field) {
+				only = append(only, d)
+			}
+		}
+		diffs = only
+	}
+	return writeConfig(configFile(c.configFileName()), diffs)
+}
+
+// SaveConfig writes runtime changes of every network to the config file, see Connection.SaveConfig
+func (b *Bot) SaveConfig() error {
+	diffs, err := b.configDiffs()
+	if err != nil {
+		return err
+	}
+	return writeConfig(configFile(b.ConfigFile), diffs)
+}
+
+// writeConfig changes the options in filename, and writes it in the same format
+func writeConfig(filename string, diffs []configDiff) error {
+	if len(diffs) == 0 {
+		return nil
+	}
+	configFileLock.Lock()
+	defer configFileLock.Unlock()
+	tree, err := readConfigTree(filename)
+	if os.IsNotExist(err) {
+		tree, err = make(map[string]interface{}), nil
+	}
+	if err != nil {
+		return err
+	}
+	// same types from any format
+	b, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	v, err := decodeJSON(b)
+	if err != nil {
+		return err
+	}
+	tree = v.(map[string]interface{})
+	for _, d := range diffs {
+		v, err := decodeJSON(d.Running)
+		if err != nil {
+			return err
+		}
+		section := tree
+		if d.Network != "" {
+			section = networkSection(tree, d.Network)
+		}
+		setKey(section, d.Field, v)
+	}
+	var out []byte
+	switch configFormat(filename) {
+	case "toml":
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(tree)
+		out = buf.Bytes()
+	case "yaml":
+		out, err = yaml.Marshal(tree)
+	default:
+		out, err = json.MarshalIndent(tree, " ", " ")
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, out, configBackups)
+}
+
+// decodeJSON decodes b with integers as int64, not float64
+func decodeJSON(b []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return plain(v), nil
+}
+
+// plain replaces json.Number with int64 or float64
+func plain(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = plain(v[k])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = plain(v[i])
+		}
+	}
+	return v
+}
+
+// setKey sets a field, using the file's key if it has the field in another case (such as 'nick' in yaml)
+func setKey(m map[string]interface{}, field string, v interface{}) {
+	for k := range m {
+		if strings.EqualFold(k, field) {
+			m[k] = v
+			return
+		}
+	}
+	m[field] = v
+}
+
+// networkSection returns the named network's options from tree, adding it if needed
+func networkSection(tree map[string]interface{}, name string) map[string]interface{} {
+	key := "Networks"
+	for k := range tree {
+		if strings.EqualFold(k, key) {
+			key = k
+		}
+	}
+	list, _ := tree[key].([]interface{})
+	for _, v := range list {
+		network, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, val := range network {
+			if strings.EqualFold(k, "Network") && val == name {
+				return network
+			}
+		}
+	}
+	network := map[string]interface{}{"Network": name}
+	tree[key] = append(list, network)
+	return network
+}
+
+// writeFileAtomic replaces filename with b: written to a temp file, synced, then renamed over it.
+// The old file is kept as filename.1, older ones as filename.2 and on, up to backups.
+func writeFileAtomic(filename string, b []byte, backups int) error {
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if old, err := ioutil.ReadFile(filename); err == nil && backups > 0 {
+		for i := backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", filename, i), fmt.Sprintf("%s.%d", filename, i+1))
+		}
+		if err := ioutil.WriteFile(filename+".1", old, 0600); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// commandMasterConfig shows how the running config differs from the config file, or saves it
+func commandMasterConfig(c *Connection, irc *IRC) {
+	switch irc.Arguments[0] {
+	case "diff":
+		list, err := c.ConfigDiff()
+		if err != nil {
+			c.Log.Println("config diff error:", err)
+			irc.Reply(c, "error reading config file, check logs")
+			return
+		}
+		if len(list) == 0 {
+			irc.Reply(c, "running config is the same as "+configFile(c.configFileName()))
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("%v changes not in %s: %s", len(list), configFile(c.configFileName()), strings.Join(list, ", ")))
+	case "save":
+		if err := c.SaveConfig(); err != nil {
+			c.Log.Println("config save error:", err)
+			irc.Reply(c, "error saving config file, check logs")
+			return
+		}
+		irc.Reply(c, "saved "+configFile(c.configFileName()))
+	default:
+		irc.Reply(c, "usage: "+c.commandPrefix(irc, true)+"config <diff|save>")
+	}
+}
+
+// configFileName returns the connection's, or the bot's, ConfigFile
+func (c *Connection) configFileName() string {
+	if c.bot != nil {
+		return c.bot.ConfigFile
+	}
+	return c.ConfigFile
+}
+
+// saveConfig saves the changed fields, logging errors, see SaveConfig
+func (c *Connection) saveConfig(fields ...string) {
+	if err := c.SaveConfig(fields...); err != nil {
+		c.Log.Println("error saving config:", err)
+		c.SendMaster("error saving config: %v", err)
+	}
+}
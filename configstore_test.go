@@ -0,0 +1,121 @@
+package ircb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("IRCB_TEST_PASS", "hunter2")
+	defer os.Unsetenv("IRCB_TEST_PASS")
+
+	filename := filepath.Join(dir, "config.toml")
+	original := "Host = \"irc.example.com:6697\"\nNick = \"sally\"\nMaster = \"aerth:$\"\nNickPassword = \"${IRCB_TEST_PASS}\"\nFloodBurst = 3\n"
+	if err := ioutil.WriteFile(filename, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.NewConnection()
+	c.ConfigFile = filename
+	if diff, err := c.ConfigDiff(); err != nil || len(diff) != 0 {
+		t.Fatalf("expected no diff, got %q %v", diff, err)
+	}
+
+	c.config.Karma = false
+	c.config.CommandPrefix = "."
+	diff, err := c.ConfigDiff()
+	if err != nil || strings.Join(diff, ", ") != `CommandPrefix: "!" -> ".", Karma: true -> false` {
+		t.Fatalf("got %q %v", diff, err)
+	}
+	if err := c.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(filename)
+	if !strings.Contains(string(b), "${IRCB_TEST_PASS}") || strings.Contains(string(b), "hunter2") {
+		t.Errorf("secret not kept as it was: %s", b)
+	}
+	if backup, _ := ioutil.ReadFile(filename + ".1"); string(backup) != original {
+		t.Errorf("expected backup, got %q", backup)
+	}
+	saved, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Karma || saved.CommandPrefix != "." || saved.FloodBurst != 3 || saved.NickPassword != "hunter2" {
+		t.Errorf("got %+v", saved)
+	}
+	if diff, err := c.ConfigDiff(); err != nil || len(diff) != 0 {
+		t.Errorf("expected no diff after saving, got %q %v", diff, err)
+	}
+
+	// only the changed option, not one from a flag
+	c.config.Master = "flag"
+	c.config.Define = false
+	if err := c.SaveConfig("Define"); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err = LoadConfig(filename); err != nil || saved.Define || saved.Master != "aerth:$" {
+		t.Errorf("expected only Define saved, got %+v %v", saved, err)
+	}
+
+	// backups roll
+	for i := 0; i < 5; i++ {
+		if err := writeFileAtomic(filename, []byte{byte('a' + i)}, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, expected := range []string{"e", "d", "c", "b"} {
+		name := filename
+		if i > 0 {
+			name += "." + string('0'+rune(i))
+		}
+		if b, _ := ioutil.ReadFile(name); string(b) != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, b)
+		}
+	}
+	if _, err := os.Stat(filename + ".4"); err == nil {
+		t.Errorf("expected 3 backups")
+	}
+}
+
+func TestSaveBotConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	original := `{"Nick": "sally", "Master": "aerth:$", "Networks": [{"Network": "one", "Host": "one.example.com:6667"}]}`
+	if err := ioutil.WriteFile(filename, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := LoadBotConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := bc.NewBot()
+	bot.ConfigFile = filename
+	bot.Network("one").config.Define = false
+	bot.Network("one").config.Master = "flag"
+	if err := bot.Network("one").SaveConfig("Define"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadBotConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Define != true || len(saved.Networks) != 1 || saved.Networks[0].Define != false || saved.Networks[0].Master != "aerth:$" {
+		t.Errorf("expected define off only in network one, got %+v", saved)
+	}
+}
@@ -0,0 +1,90 @@
+package ircb
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Handler is called for each event it is subscribed to with Connection.On.
+// Returning true stops the event from reaching the handlers after it.
+// Handlers run on the connection's reader, a slow handler delays everything after it.
+type Handler func(c *Connection, irc *IRC) bool
+
+// events holds the subscribed handlers by verb, "*" for all
+type events struct {
+	lock     sync.Mutex
+	handlers map[string][]Handler
+}
+
+func newEvents() *events {
+	return &events{handlers: make(map[string][]Handler)}
+}
+
+// On subscribes fn to a verb, such as "JOIN", "KICK", "TOPIC", "INVITE" or "005".
+// Use "*" to subscribe to every message.
+//
+// Handlers for "*" run first, then the handlers for the verb, each in the order they were added.
+// The default handlers (for master and public commands, NickServ and autojoin) are added by NewConnection,
+// so they run before any added later. Channel state, nick and ISUPPORT tracking happen before all handlers.
+//
+//	c.On("INVITE", func(c *ircb.Connection, irc *ircb.IRC) bool {
+//		c.Log.Printf("invited to %s by %s", irc.Channel, irc.Nick)
+//		return false
+//	})
+func (c *Connection) On(verb string, fn Handler) {
+	verb = strings.ToUpper(verb)
+	c.events.lock.Lock()
+	defer c.events.lock.Unlock()
+	c.events.handlers[verb] = append(c.events.handlers[verb], fn)
+}
+
+// OnNumeric subscribes fn to a numeric reply, such as 353 (RPL_NAMREPLY)
+func (c *Connection) OnNumeric(numeric int, fn Handler) {
+	c.On(fmt.Sprintf("%03d", numeric), fn)
+}
+
+// emit runs the handlers for a message, returning false if nothing is subscribed to its verb
+func (c *Connection) emit(irc *IRC) (subscribed bool) {
+	c.events.lock.Lock()
+	all := c.events.handlers["*"]
+	verb := c.events.handlers[strings.ToUpper(irc.Verb)]
+	c.events.lock.Unlock()
+	for _, fn := range all {
+		if c.runHandler(fn, irc) {
+			return true
+		}
+	}
+	for _, fn := range verb {
+		if c.runHandler(fn, irc) {
+			return true
+		}
+	}
+	return len(verb) != 0
+}
+
+// runHandler calls fn, a panic is logged and does not stop other handlers
+func (c *Connection) runHandler(fn Handler, irc *IRC) (stop bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.Log.Printf("handler panic on %s: %v\n%s", irc.Verb, r, debug.Stack())
+			stop = false
+		}
+	}()
+	return fn(c, irc)
+}
+
+// On subscribes fn to a verb on every network, see Connection.On
+func (b *Bot) On(verb string, fn Handler) {
+	for _, c := range b.networks {
+		c.On(verb, fn)
+	}
+}
+
+// OnNumeric subscribes fn to a numeric reply on every network, see Connection.OnNumeric
+func (b *Bot) OnNumeric(numeric int, fn Handler) {
+	for _, c := range b.networks {
+		c.OnNumeric(numeric, fn)
+	}
+}
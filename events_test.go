@@ -0,0 +1,50 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	c := NewTestConnection()
+	var got []string
+	add := func(verb, name string, stop bool) {
+		c.On(verb, func(c *Connection, irc *IRC) bool {
+			got = append(got, name)
+			return stop
+		})
+	}
+	add("join", "join1", false)
+	add("*", "all", false)
+	c.On("JOIN", func(c *Connection, irc *IRC) bool {
+		got = append(got, "panic")
+		panic("oops")
+	})
+	add("JOIN", "join2", true)
+	add("JOIN", "join3", false)
+	c.OnNumeric(353, func(c *Connection, irc *IRC) bool {
+		got = append(got, "names")
+		return false
+	})
+
+	if !c.emit(Parse(":nick!user@host JOIN #channel")) {
+		t.Errorf("JOIN not subscribed")
+	}
+	if expected := "all join1 panic join2"; strings.Join(got, " ") != expected {
+		t.Errorf("expected %q, got %q", expected, strings.Join(got, " "))
+	}
+
+	got = nil
+	c.emit(Parse(":server 353 bot = #channel :@bot nick"))
+	if expected := "all names"; strings.Join(got, " ") != expected {
+		t.Errorf("expected %q, got %q", expected, strings.Join(got, " "))
+	}
+
+	got = nil
+	if c.emit(Parse(":nick!user@host INVITE bot #channel")) {
+		t.Errorf("INVITE should not be subscribed")
+	}
+	if expected := "all"; strings.Join(got, " ") != expected {
+		t.Errorf("expected %q, got %q", expected, strings.Join(got, " "))
+	}
+}
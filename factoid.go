@@ -0,0 +1,377 @@
+package ircb
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// dbfactoids has the history of each defined word, the current text stays in dbdef
+var dbfactoids = []byte("factoids")
+
+// factoidRevisions is how many revisions of a factoid are kept, see pruneRevisions.
+// A vandal with more nicks than this can still push out every good revision, lock the factoid.
+const factoidRevisions = 50
+
+var (
+	ErrNoFactoid  = fmt.Errorf("not defined")
+	ErrNoRevision = fmt.Errorf("no such revision")
+)
+
+// FactoidRevision is one version of a factoid
+type FactoidRevision struct {
+	Rev    int
+	Text   string // empty if undefined
+	Author string // nick, empty for definitions from before revisions
+	Time   time.Time
+}
+
+// Factoid is a defined word, with its revisions
+type Factoid struct {
+	Word      string
+	Locked    bool // only admins can change it, see 'define lock'
+	LockedBy  string
+	Revisions []FactoidRevision // oldest first
+}
+
+// Current returns the latest revision
+func (f Factoid) Current() FactoidRevision {
+	if len(f.Revisions) == 0 {
+		return FactoidRevision{}
+	}
+	return f.Revisions[len(f.Revisions)-1]
+}
+
+// Revision returns the numbered revision
+func (f Factoid) Revision(rev int) (FactoidRevision, bool) {
+	for _, r := range f.Revisions {
+		if r.Rev == rev {
+			return r, true
+		}
+	}
+	return FactoidRevision{}, false
+}
+
+// readFactoid from the database, a word defined before revisions is revision 1 without an author
+func readFactoid(defs, factoids *bolt.Bucket, word string) (*Factoid, error) {
+	f := &Factoid{Word: word}
+	if v := factoids.Get([]byte(word)); v != nil {
+		if err := json.Unmarshal(v, f); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if text := defs.Get([]byte(word)); text != nil {
+		f.Revisions = append(f.Revisions, FactoidRevision{Rev: 1, Text: string(text)})
+	}
+	return f, nil
+}
+
+// Factoid returns word's history, or ErrNoFactoid if it was never defined
+func (c *Connection) Factoid(word string) (*Factoid, error) {
+	var f *Factoid
+	err := c.boltdb.View(func(tx *bolt.Tx) error {
+		defs, factoids := c.bucket(tx, dbdef), c.bucket(tx, dbfactoids)
+		if defs == nil || factoids == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		var err error
+		f, err = readFactoid(defs, factoids, word)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Revisions) == 0 {
+		return nil, ErrNoFactoid
+	}
+	return f, nil
+}
+
+// updateFactoid calls fn with word's history, then saves it, and the current text for getDefinition
+func (c *Connection) updateFactoid(word string, fn func(f *Factoid) error) error {
+	return c.boltdb.Update(func(tx *bolt.Tx) error {
+		defs, factoids := c.bucket(tx, dbdef), c.bucket(tx, dbfactoids)
+		if defs == nil || factoids == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		f, err := readFactoid(defs, factoids, word)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+		f.Revisions = pruneRevisions(f.Revisions, factoidRevisions)
+		b, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		if err := factoids.Put([]byte(word), b); err != nil {
+			return err
+		}
+		if text := f.Current().Text; text != "" {
+			return defs.Put([]byte(word), []byte(text))
+		}
+		return defs.Delete([]byte(word))
+	})
+}
+
+// pruneRevisions keeps the newest max revisions. The oldest kept is the newest by someone
+// who did not write the others, so a vandal's edits (from a few nicks) dont push out the last good one.
+func pruneRevisions(revs []FactoidRevision, max int) []FactoidRevision {
+	if len(revs) <= max {
+		return revs
+	}
+	kept := revs[len(revs)-max+1:]
+	recent := make(map[string]bool)
+	for _, r := range kept {
+		recent[r.Author] = true
+	}
+	for i := len(revs) - max; i >= 0; i-- {
+		if !recent[revs[i].Author] {
+			return append([]FactoidRevision{revs[i]}, kept...)
+		}
+	}
+	return revs[len(revs)-max:]
+}
+
+// Define word as text, as a new revision. An empty text undefines it.
+func (c *Connection) Define(word, text, author string) error {
+	return c.updateFactoid(word, func(f *Factoid) error {
+		if text == "" && f.Current().Text == "" {
+			return ErrNoFactoid
+		}
+		f.Revisions = append(f.Revisions, FactoidRevision{Rev: f.Current().Rev + 1, Text: text, Author: author, Time: time.Now()})
+		return nil
+	})
+}
+
+// Undefine word, it can be restored with RevertFactoid
+func (c *Connection) Undefine(word, author string) error {
+	return c.Define(word, "", author)
+}
+
+// RevertFactoid defines word as it was in revision rev, as a new revision
+func (c *Connection) RevertFactoid(word string, rev int, author string) error {
+	return c.updateFactoid(word, func(f *Factoid) error {
+		r, ok := f.Revision(rev)
+		if !ok {
+			return ErrNoRevision
+		}
+		f.Revisions = append(f.Revisions, FactoidRevision{Rev: f.Current().Rev + 1, Text: r.Text, Author: author, Time: time.Now()})
+		return nil
+	})
+}
+
+// LockFactoid so only admins can change it, or unlocks it
+func (c *Connection) LockFactoid(word string, locked bool, by string) error {
+	return c.updateFactoid(word, func(f *Factoid) error {
+		if len(f.Revisions) == 0 {
+			return ErrNoFactoid
+		}
+		f.Locked, f.LockedBy = locked, by
+		if !locked {
+			f.LockedBy = ""
+		}
+		return nil
+	})
+}
+
+// SearchFactoids returns the defined words with pattern in the word or text, case insensitive.
+// A pattern in slashes, such as '/^go/', is a regular expression.
+func (c *Connection) SearchFactoids(pattern string) ([]string, error) {
+	match := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(pattern))
+	}
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		match = re.MatchString
+	}
+	var words []string
+	err := c.boltdb.View(func(tx *bolt.Tx) error {
+		defs := c.bucket(tx, dbdef)
+		if defs == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		return defs.ForEach(func(k, v []byte) error {
+			if match(string(k)) || match(string(v)) {
+				words = append(words, string(k))
+			}
+			return nil
+		})
+	})
+	sort.Strings(words)
+	return words, err
+}
+
+// canChange runs change if word is not locked, or the sender is an admin
+func (c *Connection) canChange(irc *IRC, word string, change func()) {
+	f, err := c.Factoid(word)
+	if err == ErrNoFactoid || err == nil && !f.Locked {
+		change()
+		return
+	}
+	if err != nil {
+		c.factoidError(irc, word, err)
+		return
+	}
+	if !c.authorize(irc, RoleAdmin, change) {
+		irc.ReplyUser(c, fmt.Sprintf("%q is locked", word))
+	}
+}
+
+// factoidError replies with what went wrong
+func (c *Connection) factoidError(irc *IRC, word string, err error) {
+	switch err {
+	case ErrNoFactoid, ErrNoRevision:
+		irc.Reply(c, fmt.Sprintf("%s: %v", word, err))
+	default:
+		c.Log.Println("factoid error:", err)
+		irc.ReplyUser(c, "error, check logs")
+	}
+}
+
+// commandDefine defines a word, or locks it:
+//
+//	define <word> <text>
+//	define lock|unlock <word>   admins only
+func commandDefine(c *Connection, irc *IRC) {
+	action := irc.Arguments[0]
+	if (action == "lock" || action == "unlock") && len(irc.Arguments) == 2 {
+		word := irc.Arguments[1]
+		lock := func() {
+			if err := c.LockFactoid(word, action == "lock", irc.Nick); err != nil {
+				c.factoidError(irc, word, err)
+				return
+			}
+			irc.Reply(c, fmt.Sprintf("%sed: %q", action, word))
+		}
+		if !c.authorize(irc, RoleAdmin, lock) {
+			irc.ReplyUser(c, action+" needs "+RoleAdmin.String())
+		}
+		return
+	}
+	if _, ok := c.command(action); ok {
+		irc.Reply(c, fmt.Sprintf("already defined as command: %q", action))
+		return
+	}
+	definition := strings.Join(irc.Arguments[1:], " ")
+	c.canChange(irc, action, func() {
+		if err := c.Define(action, definition, irc.Nick); err != nil {
+			c.factoidError(irc, action, err)
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("defined: %q", action))
+	})
+}
+
+// commandUndefine removes a definition, see 'factoid revert' to restore it
+func commandUndefine(c *Connection, irc *IRC) {
+	word := irc.Arguments[0]
+	c.canChange(irc, word, func() {
+		if err := c.Undefine(word, irc.Nick); err != nil {
+			c.factoidError(irc, word, err)
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("undefined: %q", word))
+	})
+}
+
+// commandFactoid shows, restores and finds definitions:
+//
+//	factoid show <word>           the definition, and who wrote it
+//	factoid history <word>        recent revisions
+//	factoid revert <word> <rev>   define it as it was
+//	factoid search <text|/regex/>
+func commandFactoid(c *Connection, irc *IRC) {
+	args := irc.Arguments
+	usage := func() {
+		irc.Reply(c, "usage: "+c.commandPrefix(irc, false)+"factoid show|history <word> | revert <word> <rev> | search <text|/regex/>")
+	}
+	if len(args) < 2 {
+		usage()
+		return
+	}
+	word := args[1]
+	switch {
+	case args[0] == "show" && len(args) == 2:
+		f, err := c.Factoid(word)
+		if err == nil && f.Current().Text == "" {
+			err = ErrNoFactoid
+		}
+		if err != nil {
+			c.factoidError(irc, word, err)
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("%s (#%v%s): %s", word, f.Current().Rev, revisionBy(f.Current()), f.Current().Text))
+	case args[0] == "history" && len(args) == 2:
+		f, err := c.Factoid(word)
+		if err != nil {
+			c.factoidError(irc, word, err)
+			return
+		}
+		var list []string
+		for i := len(f.Revisions) - 1; i >= 0 && len(list) < 5; i-- {
+			r := f.Revisions[i]
+			text := r.Text
+			if text == "" {
+				text = "(undefined)"
+			} else if len(text) > 40 {
+				text = text[:safeCut(text, 40)] + "..."
+			}
+			list = append(list, fmt.Sprintf("#%v%s: %s", r.Rev, revisionBy(r), text))
+		}
+		locked := ""
+		if f.Locked {
+			locked = " (locked by " + f.LockedBy + ")"
+		}
+		irc.Reply(c, fmt.Sprintf("%s%s: %s", word, locked, strings.Join(list, "; ")))
+	case args[0] == "revert" && len(args) == 3:
+		rev, err := strconv.Atoi(strings.TrimPrefix(args[2], "#"))
+		if err != nil {
+			usage()
+			return
+		}
+		c.canChange(irc, word, func() {
+			if err := c.RevertFactoid(word, rev, irc.Nick); err != nil {
+				c.factoidError(irc, word, err)
+				return
+			}
+			irc.Reply(c, fmt.Sprintf("reverted %q to #%v", word, rev))
+		})
+	case args[0] == "search":
+		words, err := c.SearchFactoids(strings.Join(args[1:], " "))
+		if err != nil {
+			irc.Reply(c, fmt.Sprintf("search: %v", err))
+			return
+		}
+		if len(words) == 0 {
+			irc.Reply(c, "no factoids found")
+			return
+		}
+		if len(words) > 20 {
+			words = append(words[:20], fmt.Sprintf("and %v more", len(words)-20))
+		}
+		irc.Reply(c, fmt.Sprintf("factoids: %s", strings.Join(words, ", ")))
+	default:
+		usage()
+	}
+}
+
+// revisionBy returns ' by nick 2h ago', or nothing for a revision from before revisions
+func revisionBy(r FactoidRevision) string {
+	if r.Author == "" {
+		return ""
+	}
+	return fmt.Sprintf(" by %s %s", r.Author, ago(r.Time))
+}
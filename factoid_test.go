@@ -0,0 +1,90 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestFactoids(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+	c.CommandMap = DefaultCommandMap()
+	c.config.Define = true
+	c.config.AuthMode = -1
+	c.setAccount("mallory", "")
+	tc := c.conn.(*testconnection)
+
+	// from before revisions
+	c.boltdb.Update(func(tx *bolt.Tx) error {
+		return c.bucket(tx, dbdef).Put([]byte("ircb"), []byte("a bot"))
+	})
+	for _, tt := range []struct {
+		from, command, expected string
+	}{
+		{"alice", "!factoid show ircb", "ircb (#1): a bot"},
+		{"alice", "!define ircb a bot that lives on irc", `defined: "ircb"`},
+		{"mallory", "!define ircb spam", `defined: "ircb"`},
+		{"alice", "!factoid history ircb", "ircb: #3 by mallory just now: spam; #2 by alice just now: a bot that lives on irc; #1: a bot"},
+		{"alice", "!factoid revert ircb 2", `reverted "ircb" to #2`},
+		{"alice", "!ircb", "a bot that lives on irc"},
+		{"mallory", "!define lock ircb", "lock needs admin"},
+		{"tester", "!define lock ircb", `locked: "ircb"`},
+		{"mallory", "!undefine ircb", `"ircb" is locked`},
+		{"mallory", "!factoid revert ircb 3", `"ircb" is locked`},
+		{"alice", "!factoid search LIVES", "factoids: ircb"},
+		{"alice", "!factoid search /^i.c/", "factoids: ircb"},
+		{"alice", "!factoid search /(/", "search: error parsing regexp"},
+		{"alice", "!factoid search nothing", "no factoids found"},
+		{"tester", "!undefine ircb", `undefined: "ircb"`},
+		{"alice", "!factoid show ircb", "ircb: not defined"},
+		{"tester", "!factoid revert ircb 9", "ircb: no such revision"},
+		{"alice", "!undefine nothing", "nothing: not defined"},
+	} {
+		tc.buf.Reset()
+		irc := c.config.Parse(":" + tt.from + "!u@h PRIVMSG #chan :" + tt.command)
+		if !privmsgHandler(c, irc) {
+			t.Errorf("%q: not handled", tt.command)
+		}
+		if !strings.Contains(tc.buf.String(), tt.expected) {
+			t.Errorf("%s %q: expected %q, got %q", tt.from, tt.command, tt.expected, tc.buf.String())
+		}
+	}
+	f, err := c.Factoid("ircb")
+	if err != nil || !f.Locked || f.LockedBy != "tester" || f.Current().Rev != 5 || f.Current().Text != "" {
+		t.Errorf("got %+v %v", f, err)
+	}
+
+	// an unreadable factoid can't be changed
+	c.boltdb.Update(func(tx *bolt.Tx) error {
+		return c.bucket(tx, dbfactoids).Put([]byte("broken"), []byte("{"))
+	})
+	ran := false
+	c.canChange(c.config.Parse(":mallory!u@h PRIVMSG #chan :!define broken spam"), "broken", func() { ran = true })
+	if ran {
+		t.Errorf("changed a factoid that could not be read")
+	}
+
+	// history is cut between runes
+	c.Define("go", strings.Repeat("ü", 30), "alice")
+	tc.buf.Reset()
+	privmsgHandler(c, c.config.Parse(":alice!u@h PRIVMSG #chan :!factoid history go"))
+	if expected := strings.Repeat("ü", 20) + "..."; !strings.Contains(tc.buf.String(), expected) {
+		t.Errorf("expected %q, got %q", expected, tc.buf.String())
+	}
+
+	// many edits, from two nicks, keep the last revision by someone else
+	for i := 0; i < factoidRevisions+10; i++ {
+		if err := c.Define("go", "spam", []string{"mallory", "eve"}[i%2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err = c.Factoid("go")
+	if err != nil || len(f.Revisions) != factoidRevisions || f.Revisions[0].Author != "alice" || f.Revisions[1].Author == "alice" {
+		t.Fatalf("expected alice's revision kept, got %+v %v", f, err)
+	}
+	if err := c.RevertFactoid("go", f.Revisions[0].Rev, "alice"); err != nil || c.getDefinition("go") != strings.Repeat("ü", 30) {
+		t.Errorf("revert: %v", err)
+	}
+}
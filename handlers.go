@@ -26,31 +26,62 @@ func verbIntHandler(c *Connection, irc *IRC) bool {
 	case 353:
 		c.Log.Printf("%s USER LIST: %q", irc.Raw, "")
 		return handled
-	case 372, 1, 2, 3, 4, 5, 6, 7, 0, 366:
+	case 5:
+		c.isupportHandler(irc)
+		return handled
+	case 372, 1, 2, 3, 4, 6, 7, 0, 366, 332, 333, 324, 329, 367, 368:
 		return handled
 	case 221:
 		c.Log.Printf("UMODE: %q", irc.Message)
 		return handled
-	case 433:
-		c.Close()
+	case 432, 433, 436:
+		c.nickError(irc)
 		return handled
 	}
 
 }
 
-// handle anything from master, returning false if message has not been handled
-func privmsgMasterHandler(c *Connection, irc *IRC) bool {
-	if irc.ReplyTo != strings.Split(c.config.Master, ":")[0] {
-		c.Log.Printf("not master: %s", irc.ReplyTo)
+// nickservHandler logs notices, see learnAccount for NickServ replies
+func nickservHandler(c *Connection, irc *IRC) bool {
+	c.Log.Println("NOTICE", irc.ReplyTo, irc.Message)
+	return nothandled
+}
+
+// autojoinHandler joins channels after the first MODE (our +i)
+func autojoinHandler(c *Connection, irc *IRC) bool {
+	c.Log.Printf("NEW MODE: %q", irc.Message)
+	if !c.joined {
+		for _, ch := range c.autojoin() {
+			c.Log.Println("Joining channel:", ch)
+			c.Write([]byte(fmt.Sprintf("JOIN %s", ch)))
+		}
+		c.joined = true
+		c.Log.Println("Starting normal operation")
+		c.SendMaster("hello, master")
+	}
+	return nothandled
+}
+
+// commandHandler runs master and public commands, karma and definitions.
+// It does not stop other PRIVMSG handlers.
+func commandHandler(c *Connection, irc *IRC) bool {
+	// our own message, from echo-message
+	if irc.Nick == c.config.Nick {
 		return nothandled
 	}
 
-	if dur := time.Now().Sub(c.masterauth); dur > 5*time.Minute {
-		c.Log.Println("need reauth after", dur)
-		c.MasterCheck()
-		defer c.SendMaster("you are now authenticated for 5 minutes")
-		return privmsgMasterHandler(c, irc)
+	// maybe master command
+	if privmsgMasterHandler(c, irc) {
+		return nothandled
 	}
+
+	privmsgHandler(c, irc)
+	return nothandled
+}
+
+// handle master commands, returning false if message has not been handled.
+// Master commands (and the prefix switch) only run for those with the command's role, see Connection.Role.
+func privmsgMasterHandler(c *Connection, irc *IRC) bool {
 	i := strings.Index(c.config.Master, ":")
 	if i == -1 {
 		c.Log.Println("*** bad config, not semicolon in Master field")
@@ -64,55 +95,58 @@ func privmsgMasterHandler(c *Connection, irc *IRC) bool {
 	mp := c.config.Master[i+1:] // master prefix
 	if !strings.HasPrefix(irc.Message, mp) {
 		// switch prefix
-		if irc.Command == c.config.CommandPrefix && len(irc.Arguments) == 1 {
-			c.config.CommandPrefix = irc.Arguments[0]
-			c.Log.Printf("**New command prefix: %q", c.config.CommandPrefix)
-			c.SendMaster("**New command prefix: %q", c.config.CommandPrefix)
+		if irc.Command == c.config.CommandPrefix && len(irc.Arguments) == 1 &&
+			c.authorize(irc, RoleAdmin, func() { commandMasterPrefix(c, irc) }) {
 			return handled
 		}
 
 		// was not a prefix switch
-		// just master sending messages or normal commands
+		// just sending messages or normal commands
 		return nothandled
 	}
-	// re-parse for master command
-	irc.Message = strings.TrimPrefix(irc.Message, mp)
-	irc.Command = strings.TrimSpace(strings.Split(irc.Message, " ")[0])
-	args := strings.Split(strings.TrimPrefix(irc.Message, irc.Command), " ")
+	// re-parse for master command, a copy in case it is not one
+	m := *irc
+	m.Message = strings.TrimPrefix(irc.Message, mp)
+	m.Command = strings.TrimSpace(strings.Split(m.Message, " ")[0])
+	m.Arguments = nil
+	args := strings.Split(strings.TrimPrefix(m.Message, m.Command), " ")
 	for _, v := range args {
 		if strings.TrimSpace(v) != "" {
-			irc.Arguments = append(irc.Arguments, v)
+			m.Arguments = append(m.Arguments, v)
 		}
 	}
-	if c.config.Verbose {
-		c.Log.Printf("master command parsed: %s", irc)
+	if m.Command == "" {
+		return nothandled
 	}
-	if irc.Command != "" {
-		if fn, ok := c.MasterMap[irc.Command]; ok {
-			c.Log.Printf("master command found: %q", irc.Command)
-			fn(c, irc)
+	fn, ok := c.masterCommand(m.Command)
+	if !ok {
+		if c.Role(&m) >= RoleAdmin {
+			irc.Reply(c, "master command not found")
 			return handled
 		}
-		c.SendMaster("master command not found")
+		return nothandled
 	}
-	return nothandled
-
+	if c.config.Verbose {
+		c.Log.Printf("master command parsed: %s", &m)
+	}
+	c.Log.Printf("master command found: %q from %s", m.Command, m.Prefix)
+	return c.authorize(&m, c.commandRole(m.Command, true), func() { fn(c, &m) })
 }
 
 // handle any PRIVMSG, should go *after* privmsgMasterHandler and verbintHandler
 func privmsgHandler(c *Connection, irc *IRC) bool {
 
 	// is karma, sent to a channel (not /msg)
-	if strings.HasPrefix(irc.To, "#") && c.parseKarma(irc.Message) {
+	if c.IsChannel(irc.To) && c.Settings(irc.To).Karma && c.parseKarma(irc) {
 		return handled
 
 	}
 
 	// is parsed as command
 	if irc.Command != "" {
-		if fn, ok := c.CommandMap[irc.Command]; ok {
+		if fn, ok := c.command(irc.Command); ok {
 			c.Log.Printf("command found: %q", irc.Command)
-			fn(c, irc)
+			c.authorize(irc, c.commandRole(irc.Command, false), func() { fn(c, irc) })
 			return handled
 		}
 	}
@@ -129,7 +163,7 @@ func privmsgHandler(c *Connection, irc *IRC) bool {
 		irc.ReplyUser(c, "command not found. try the 'help' command")
 	}
 	// try to parse http link title
-	if c.config.ParseLinks && strings.Contains(irc.Message, "http") {
+	if c.Settings(irc.To).ParseLinks && strings.Contains(irc.Message, "http") {
 		if c.linkhandler(irc) {
 			return handled
 		}
@@ -141,7 +175,7 @@ func privmsgHandler(c *Connection, irc *IRC) bool {
 
 // linkhandler replies to messages with http links
 func (c *Connection) linkhandler(irc *IRC) bool {
-	if !c.config.ParseLinks {
+	if !c.Settings(irc.To).ParseLinks {
 		return nothandled
 	}
 	// word starts with http and is url parsable
@@ -171,7 +205,7 @@ func (c *Connection) linkhandler(irc *IRC) bool {
 	}
 
 	c.Log.Println("sending http request:", ss)
-	defer c.Log.Println("done handling link %q in %q", ss, irc.ReplyTo)
+	defer c.Log.Printf("done handling link %q in %q", ss, irc.ReplyTo)
 	t1 := time.Now()
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
@@ -72,7 +72,6 @@ func getLinkTitleFromHTML(htmlbytes []byte) *htmlMeta {
 			}
 		}
 	}
-	return hm
 }
 
 func extractMetaProperty(t html.Token, prop string) (content string, ok bool) {
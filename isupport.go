@@ -0,0 +1,231 @@
+package ircb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ISupport holds the network features advertised in RPL_ISUPPORT (005), see Connection.ISupport
+type ISupport struct {
+	ChanTypes     string            // channel prefixes, such as '#&'
+	PrefixModes   string            // channel privilege modes, highest first, such as 'ov'
+	PrefixSymbols string            // symbols for PrefixModes, such as '@+'
+	CaseMapping   string            // 'rfc1459', 'rfc1459-strict' or 'ascii'
+	NickLen       int               // max nick length
+	TargMax       map[string]int    // max targets by command, 0 for no limit
+	LineLen       int               // max line length, including '\r\n'
+	ChanModes     [4]string         // CHANMODES types A (lists), B (always param), C (param when set), D (no param)
+	Network       string            // network name
+	Tokens        map[string]string // everything as received, by name
+}
+
+// DefaultISupport returns the RFC 1459 defaults, used until the server tells us otherwise
+func DefaultISupport() ISupport {
+	return ISupport{
+		ChanTypes:     defaultChanTypes,
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+		CaseMapping:   "rfc1459",
+		NickLen:       9,
+		TargMax:       make(map[string]int),
+		LineLen:       512,
+		ChanModes:     [4]string{"beI", "k", "l", "imnpst"},
+		Tokens:        make(map[string]string),
+	}
+}
+
+// parse tokens from one RPL_ISUPPORT line, such as 'CHANTYPES=#&' or '-EXCEPTS'
+func (is *ISupport) parse(tokens []string) {
+	defaults := DefaultISupport()
+	for _, token := range tokens {
+		if strings.HasPrefix(token, "-") {
+			// negated, back to default
+			token = strings.ToUpper(token[1:])
+			delete(is.Tokens, token)
+			switch token {
+			case "CHANTYPES":
+				is.ChanTypes = defaults.ChanTypes
+			case "PREFIX":
+				is.PrefixModes, is.PrefixSymbols = defaults.PrefixModes, defaults.PrefixSymbols
+			case "CASEMAPPING":
+				is.CaseMapping = defaults.CaseMapping
+			case "NICKLEN":
+				is.NickLen = defaults.NickLen
+			case "TARGMAX":
+				is.TargMax = defaults.TargMax
+			case "LINELEN":
+				is.LineLen = defaults.LineLen
+			case "CHANMODES":
+				is.ChanModes = defaults.ChanModes
+			case "NETWORK":
+				is.Network = ""
+			}
+			continue
+		}
+		kv := strings.SplitN(token, "=", 2)
+		key, value := strings.ToUpper(kv[0]), ""
+		if len(kv) == 2 {
+			value = unescapeISupport(kv[1])
+		}
+		is.Tokens[key] = value
+		switch key {
+		case "CHANTYPES":
+			is.ChanTypes = value
+		case "PREFIX":
+			// (modes)symbols
+			if i := strings.IndexByte(value, ')'); strings.HasPrefix(value, "(") && i != -1 &&
+				len(value[1:i]) == len(value[i+1:]) {
+				is.PrefixModes, is.PrefixSymbols = value[1:i], value[i+1:]
+			}
+		case "CASEMAPPING":
+			is.CaseMapping = strings.ToLower(value)
+		case "NICKLEN":
+			if n, err := strconv.Atoi(value); err == nil {
+				is.NickLen = n
+			}
+		case "LINELEN":
+			if n, err := strconv.Atoi(value); err == nil && n >= 512 {
+				is.LineLen = n
+			}
+		case "TARGMAX":
+			is.TargMax = make(map[string]int)
+			for _, v := range strings.Split(value, ",") {
+				cmdmax := strings.SplitN(v, ":", 2)
+				if len(cmdmax) != 2 {
+					continue
+				}
+				n, _ := strconv.Atoi(cmdmax[1])
+				is.TargMax[strings.ToUpper(cmdmax[0])] = n
+			}
+		case "CHANMODES":
+			var modes [4]string
+			copy(modes[:], strings.Split(value, ","))
+			is.ChanModes = modes
+		case "NETWORK":
+			is.Network = value
+		}
+	}
+}
+
+// unescapeISupport replaces '\xHH' escapes in token values
+func unescapeISupport(s string) string {
+	for {
+		i := strings.Index(s, `\x`)
+		if i == -1 || i+4 > len(s) {
+			return s
+		}
+		b, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+		if err != nil {
+			return s
+		}
+		s = s[:i] + string([]byte{byte(b)}) + s[i+4:]
+	}
+}
+
+// fold returns s in lower case, according to casemapping
+func fold(casemapping, s string) string {
+	var upper, lower string
+	switch casemapping {
+	case "ascii":
+	case "rfc1459-strict":
+		upper, lower = `[]\`, "{}|"
+	case "rfc1459":
+		upper, lower = `[]\~`, "{}|^"
+	default:
+		// such as 'rfc7613', unicode aware
+		return strings.ToLower(s)
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		} else if j := strings.IndexByte(upper, c); j != -1 {
+			b[i] = lower[j]
+		}
+	}
+	return string(b)
+}
+
+// ISupport returns a copy of the network features advertised by the server
+func (c *Connection) ISupport() ISupport {
+	c.supportlock.Lock()
+	defer c.supportlock.Unlock()
+	is := c.isupport
+	is.TargMax = make(map[string]int, len(c.isupport.TargMax))
+	for k, v := range c.isupport.TargMax {
+		is.TargMax[k] = v
+	}
+	is.Tokens = make(map[string]string, len(c.isupport.Tokens))
+	for k, v := range c.isupport.Tokens {
+		is.Tokens[k] = v
+	}
+	return is
+}
+
+// IsChannel returns true if name starts with one of the network's channel types
+func (c *Connection) IsChannel(name string) bool {
+	c.supportlock.Lock()
+	defer c.supportlock.Unlock()
+	return name != "" && strings.IndexByte(c.isupport.ChanTypes, name[0]) != -1
+}
+
+// Fold returns a nick or channel name in lower case, using the network's casemapping
+func (c *Connection) Fold(s string) string {
+	c.supportlock.Lock()
+	defer c.supportlock.Unlock()
+	return fold(c.isupport.CaseMapping, s)
+}
+
+// EqualFold returns true if a and b are the same nick or channel on this network
+func (c *Connection) EqualFold(a, b string) bool {
+	return c.Fold(a) == c.Fold(b)
+}
+
+// chanTypes for parsing
+func (c *Connection) chanTypes() string {
+	c.supportlock.Lock()
+	defer c.supportlock.Unlock()
+	return c.isupport.ChanTypes
+}
+
+// resetISupport before connecting
+func (c *Connection) resetISupport() {
+	c.supportlock.Lock()
+	c.isupport = DefaultISupport()
+	c.supportlock.Unlock()
+	c.applyISupport()
+}
+
+// isupportHandler handles RPL_ISUPPORT: ':server 005 nick TOKEN TOKEN=value :are supported'
+func (c *Connection) isupportHandler(irc *IRC) {
+	if len(irc.Params) < 3 {
+		return
+	}
+	c.supportlock.Lock()
+	c.isupport.parse(irc.Params[1 : len(irc.Params)-1])
+	c.supportlock.Unlock()
+	c.applyISupport()
+}
+
+// applyISupport to channel state
+func (c *Connection) applyISupport() {
+	is := c.ISupport()
+	c.chans.mu.Lock()
+	defer c.chans.mu.Unlock()
+	c.chans.prefixModes, c.chans.prefixSymbols = is.PrefixModes, is.PrefixSymbols
+	c.chans.listModes, c.chans.paramModes, c.chans.setParamModes = is.ChanModes[0], is.ChanModes[1], is.ChanModes[2]
+	casemapping := is.CaseMapping
+	c.chans.fold = func(s string) string { return fold(casemapping, s) }
+
+	// names may fold differently now
+	channels := make(map[string]*Channel, len(c.chans.channels))
+	for _, ch := range c.chans.channels {
+		members := make(map[string]Member, len(ch.Members))
+		for _, m := range ch.Members {
+			members[c.chans.fold(m.Nick)] = m
+		}
+		ch.Members = members
+		channels[c.chans.fold(ch.Name)] = ch
+	}
+	c.chans.channels = channels
+}
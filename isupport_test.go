@@ -0,0 +1,34 @@
+package ircb
+
+import "testing"
+
+func TestISupport(t *testing.T) {
+	c := NewTestConnection()
+	c.isupportHandler(Parse(":host.test 005 testing CHANTYPES=#&! PREFIX=(qaohv)~&@%+ CASEMAPPING=rfc1459 NICKLEN=16 :are supported by this server"))
+	c.isupportHandler(Parse(":host.test 005 testing TARGMAX=PRIVMSG:4,JOIN: LINELEN=1024 CHANMODES=beI,k,l,imnpst NETWORK=Test\\x20Net :are supported by this server"))
+	is := c.ISupport()
+	if is.PrefixModes != "qaohv" || is.PrefixSymbols != "~&@%+" || is.NickLen != 16 || is.LineLen != 1024 {
+		t.Errorf("bad isupport: %#v", is)
+	}
+	if is.TargMax["PRIVMSG"] != 4 || is.TargMax["JOIN"] != 0 || is.Network != "Test Net" || is.ChanModes[3] != "imnpst" {
+		t.Errorf("bad isupport: %#v", is)
+	}
+	if !c.IsChannel("!chan") || !c.IsChannel("&chan") || c.IsChannel("nick") {
+		t.Error("bad chantypes")
+	}
+	if c.Fold("Nick[]\\~") != "nick{}|^" {
+		t.Errorf("got %q", c.Fold("Nick[]\\~"))
+	}
+
+	// halfop and owner, with the new prefixes
+	c.trackChannels(Parse(":testing!u@h JOIN !chan"))
+	c.trackChannels(Parse(":host.test 353 testing = !chan :~owner %half"))
+	if !c.IsOp("!chan", "OWNER") || c.IsOp("!chan", "half") || !c.IsVoice("!chan", "half") {
+		t.Error("bad prefixes")
+	}
+
+	c.isupportHandler(Parse(":host.test 005 testing -CHANTYPES :are supported by this server"))
+	if c.IsChannel("!chan") {
+		t.Error("negated CHANTYPES")
+	}
+}
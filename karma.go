@@ -0,0 +1,628 @@
+package ircb
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	dbkarmalog   = []byte("karmalog")
+	dbkarmaalias = []byte("karmaalias")
+	dbkarmachan  = []byte("karmachan") // a bucket for each channel with local karma, by folded name
+)
+
+// karmaLogMax is how many karma events are kept, older ones are removed
+const karmaLogMax = 10000
+
+// default limits, see Config.KarmaCooldown and Config.KarmaDailyCap
+const (
+	karmaCooldown = time.Minute
+	karmaDailyCap = 30
+)
+
+var (
+	ErrSelfKarma     = fmt.Errorf("no karma for yourself")
+	ErrKarmaCooldown = fmt.Errorf("karma cooling down")
+	ErrKarmaCap      = fmt.Errorf("no more karma to give today")
+)
+
+// KarmaEvent is karma given (or taken) by someone, see Connection.KarmaLog
+type KarmaEvent struct {
+	Time    time.Time
+	From    string // nick of the giver
+	Giver   string `json:",omitempty"` // the giver's karma name, see Connection.KarmaName
+	To      string // karma name
+	Channel string
+	Delta   int    // 1 or -1
+	Reason  string `json:",omitempty"` // from 'nick++ # reason'
+}
+
+// KarmaScore is a name's karma, see Connection.KarmaScores
+type KarmaScore struct {
+	Name  string
+	Karma int
+}
+
+// karmaReason splits 'nick++ # reason' into 'nick++' and 'reason'
+func karmaReason(input string) (string, string) {
+	i := strings.Index(input, "# ")
+	if i == -1 {
+		if strings.HasSuffix(input, " #") {
+			return strings.TrimSpace(strings.TrimSuffix(input, "#")), ""
+		}
+		return input, ""
+	}
+	return strings.TrimSpace(input[:i]), strings.TrimSpace(input[i+2:])
+}
+
+// DefaultKarmaIgnore are words that look like karma but are not, such as 'c++' and 'i--'
+var DefaultKarmaIgnore = []string{"c", "g", "i", "j", "k", "n", "x", "y", "z", "notepad"}
+
+// karmaOp is karma found in a message
+type karmaOp struct {
+	Name  string
+	Delta int
+}
+
+var (
+	codespan    = regexp.MustCompile("`[^`]*`?")
+	karmaword   = regexp.MustCompile(`\(([^()]+)\)(\+\++|--+)|\S+`)
+	karmathanks = regexp.MustCompile(`(?i)(?:^|\s)([^\s:,()]+)[:,]\s+(?:[^\s:,]+\s+){0,3}?(?:thanks?|thx|ty)\b`)
+)
+
+// karmaOps finds karma anywhere in a message, any number of times:
+//
+//	nick++, nick--, (some thing)++, nick: thanks
+//
+// A message that is one word can also be 'nick+' or 'nick-'.
+// Code spans (in backticks), URLs and ignored words (case insensitive) are not karma.
+func karmaOps(message string, ignore []string) []karmaOp {
+	message = codespan.ReplaceAllString(message, " ")
+	var words []string
+	for _, word := range strings.Fields(message) {
+		if !strings.Contains(word, "://") && !strings.HasPrefix(strings.ToLower(word), "www.") {
+			words = append(words, word)
+		}
+	}
+	message = strings.Join(words, " ")
+	var ops []karmaOp
+	add := func(name string, delta int) {
+		name = strings.TrimSpace(name)
+		// not numbers, such as 'x = 1--'
+		if name == "" || strings.ContainsAny(name[:1], "0123456789+-") {
+			return
+		}
+		// not arrows, such as '<--'
+		if strings.IndexFunc(name, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) == -1 {
+			return
+		}
+		for _, word := range ignore {
+			if strings.EqualFold(word, name) {
+				return
+			}
+		}
+		ops = append(ops, karmaOp{name, delta})
+	}
+	single := len(words) == 1
+	for _, m := range karmaword.FindAllStringSubmatch(message, -1) {
+		if m[1] != "" {
+			// (some thing)++
+			add(m[1], karmaDelta(m[2]))
+			continue
+		}
+		word := strings.TrimRight(m[0], ",.;:!?)")
+		switch {
+		case strings.HasSuffix(word, "++"), single && strings.HasSuffix(word, "+"):
+			add(strings.TrimRight(word, "+"), 1)
+		case strings.HasSuffix(word, "--"), single && strings.HasSuffix(word, "-"):
+			add(strings.TrimRight(word, "-"), -1)
+		}
+	}
+	for _, m := range karmathanks.FindAllStringSubmatch(message, -1) {
+		add(m[1], 1)
+	}
+	return ops
+}
+
+// karmaDelta is 1 for '++', -1 for '--'
+func karmaDelta(op string) int {
+	if strings.HasPrefix(op, "-") {
+		return -1
+	}
+	return 1
+}
+
+// karmaFold folds name with the network's casemapping, without trailing underscores (alternate nicks)
+func (c *Connection) karmaFold(name string) string {
+	name = c.Fold(strings.TrimSpace(name))
+	if trimmed := strings.TrimRight(name, "_"); trimmed != "" {
+		return trimmed
+	}
+	return name
+}
+
+// KarmaName returns the name karma for name is kept under: folded (see Connection.Fold) without trailing underscores,
+// then the services account of a logged in nick (see Config.KarmaAccounts), or an alias (see 'karma alias' master command).
+func (c *Connection) KarmaName(name string) string {
+	key := c.karmaFold(name)
+	if c.config.KarmaAccounts {
+		if account, known := c.Account(name); known && account != "" {
+			key = c.karmaFold(account)
+		}
+	}
+	if alias := c.karmaAlias(key); alias != "" {
+		return alias
+	}
+	return key
+}
+
+// karmaAlias returns the name key is an alias of, or empty.
+// It opens a tx, so dont call it (or KarmaName) inside one.
+func (c *Connection) karmaAlias(key string) string {
+	var alias string
+	if c.boltdb == nil {
+		return ""
+	}
+	c.boltdb.View(func(tx *bolt.Tx) error {
+		if bucket := c.bucket(tx, dbkarmaalias); bucket != nil {
+			alias = string(bucket.Get([]byte(key)))
+		}
+		return nil
+	})
+	return alias
+}
+
+// SetKarmaAlias makes karma for alias go to name, moving any karma alias has
+func (c *Connection) SetKarmaAlias(alias, name string) error {
+	from, to := c.karmaFold(alias), c.KarmaName(name)
+	if from == to {
+		return fmt.Errorf("%s is %s", alias, name)
+	}
+	return c.boltdb.Update(func(tx *bolt.Tx) error {
+		aliases := c.bucket(tx, dbkarmaalias)
+		// aliases of alias follow it
+		err := aliases.ForEach(func(k, v []byte) error {
+			if string(v) == from {
+				return aliases.Put(k, []byte(to))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := aliases.Put([]byte(from), []byte(to)); err != nil {
+			return err
+		}
+		return c.eachKarmaBucket(tx, func(bucket *bolt.Bucket) error {
+			return mergeKarma(bucket, from, to)
+		})
+	})
+}
+
+// RemoveKarmaAlias stops aliasing, karma already given stays with the name
+func (c *Connection) RemoveKarmaAlias(alias string) error {
+	return c.boltdb.Update(func(tx *bolt.Tx) error {
+		return c.bucket(tx, dbkarmaalias).Delete([]byte(c.karmaFold(alias)))
+	})
+}
+
+// KarmaAliases returns aliases and the names they go to
+func (c *Connection) KarmaAliases() map[string]string {
+	aliases := make(map[string]string)
+	c.boltdb.View(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbkarmaalias)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			aliases[string(k)] = string(v)
+			return nil
+		})
+	})
+	return aliases
+}
+
+// karmaBoard returns the scoreboard for channel: the folded channel if it has local karma (see 'channel' master command),
+// otherwise empty for the global one. Settings can read the database, so call it before opening a tx.
+func (c *Connection) karmaBoard(channel string) string {
+	if !c.IsChannel(channel) || !c.Settings(channel).LocalKarma {
+		return ""
+	}
+	return c.Fold(channel)
+}
+
+// karmaBucket returns the scoreboard named by karmaBoard.
+// In a read-only tx, it is nil for a channel without karma yet.
+func (c *Connection) karmaBucket(tx *bolt.Tx, board string) (*bolt.Bucket, error) {
+	if board == "" {
+		return c.bucket(tx, dbkarma), nil
+	}
+	chans := c.bucket(tx, dbkarmachan)
+	if chans == nil {
+		return nil, fmt.Errorf("nil bucket")
+	}
+	if tx.Writable() {
+		return chans.CreateBucketIfNotExists([]byte(board))
+	}
+	return chans.Bucket([]byte(board)), nil
+}
+
+// eachKarmaBucket calls fn with the global scoreboard, then each channel's
+func (c *Connection) eachKarmaBucket(tx *bolt.Tx, fn func(bucket *bolt.Bucket) error) error {
+	bucket := c.bucket(tx, dbkarma)
+	if bucket == nil {
+		return fmt.Errorf("nil bucket")
+	}
+	if err := fn(bucket); err != nil {
+		return err
+	}
+	chans := c.bucket(tx, dbkarmachan)
+	if chans == nil {
+		return nil
+	}
+	return chans.ForEach(func(k, v []byte) error {
+		if bucket := chans.Bucket(k); bucket != nil {
+			return fn(bucket)
+		}
+		return nil
+	})
+}
+
+// GlobalKarma returns name's karma in every channel, local scoreboards and the global one
+func (c *Connection) GlobalKarma(name string) int {
+	key := []byte(c.KarmaName(name))
+	sum := 0
+	err := c.boltdb.View(func(tx *bolt.Tx) error {
+		return c.eachKarmaBucket(tx, func(bucket *bolt.Bucket) error {
+			sum += bytes2int(bucket.Get(key))
+			return nil
+		})
+	})
+	if err != nil {
+		c.Log.Println("karma error:", err)
+	}
+	return sum
+}
+
+// mergeKarma adds the karma of from to to, and removes from
+func mergeKarma(bucket *bolt.Bucket, from, to string) error {
+	v := bucket.Get([]byte(from))
+	if v == nil || from == to {
+		return nil
+	}
+	sum := bytes2int(bucket.Get([]byte(to))) + bytes2int(v)
+	if err := bucket.Put([]byte(to), int2bytes(sum)); err != nil {
+		return err
+	}
+	return bucket.Delete([]byte(from))
+}
+
+// MigrateKarma merges karma kept under names from before KarmaName, such as 'Alice', 'alice' and 'alice_'.
+// It returns how many names were merged.
+func (c *Connection) MigrateKarma() (int, error) {
+	aliases := c.KarmaAliases()
+	merged := 0
+	err := c.boltdb.Update(func(tx *bolt.Tx) error {
+		return c.eachKarmaBucket(tx, func(bucket *bolt.Bucket) error {
+			moves := make(map[string]string)
+			err := bucket.ForEach(func(k, v []byte) error {
+				key := c.karmaFold(string(k))
+				if alias, ok := aliases[key]; ok {
+					key = alias
+				}
+				if key != string(k) {
+					moves[string(k)] = key
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for from, to := range moves {
+				if err := mergeKarma(bucket, from, to); err != nil {
+					return err
+				}
+				merged++
+			}
+			return nil
+		})
+	})
+	return merged, err
+}
+
+// checkKarma returns an error if e is too much karma from e.Giver, see Config.KarmaCooldown
+func (c *Connection) checkKarma(log *bolt.Bucket, e KarmaEvent) error {
+	if e.Giver == "" {
+		return nil
+	}
+	if e.Giver == e.To {
+		return ErrSelfKarma
+	}
+	cooldown := time.Duration(c.config.KarmaCooldown) * time.Second
+	if c.config.KarmaCooldown == 0 {
+		cooldown = karmaCooldown
+	}
+	daily := c.config.KarmaDailyCap
+	if daily == 0 {
+		daily = karmaDailyCap
+	}
+	given := 0
+	cursor := log.Cursor()
+	for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+		var old KarmaEvent
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+		since := e.Time.Sub(old.Time)
+		if since > 24*time.Hour {
+			break
+		}
+		if old.Giver != e.Giver {
+			continue
+		}
+		if old.To == e.To && since < cooldown {
+			return ErrKarmaCooldown
+		}
+		given++
+		if daily > 0 && given >= daily {
+			return ErrKarmaCap
+		}
+	}
+	return nil
+}
+
+// addKarma changes a score on the channel's scoreboard (see karmaBoard) and logs the event,
+// unless it is too much (see checkKarma)
+func (c *Connection) addKarma(e KarmaEvent) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	board := c.karmaBoard(e.Channel)
+	return c.boltdb.Update(func(tx *bolt.Tx) error {
+		if err := c.checkKarma(c.bucket(tx, dbkarmalog), e); err != nil {
+			return err
+		}
+		bucket, err := c.karmaBucket(tx, board)
+		if err != nil {
+			return err
+		}
+		current := bytes2int(bucket.Get([]byte(e.To)))
+		if err := bucket.Put([]byte(e.To), int2bytes(current+e.Delta)); err != nil {
+			return err
+		}
+		log := c.bucket(tx, dbkarmalog)
+		seq, err := log.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := log.Put(int2bytes(int(seq)), b); err != nil {
+			return err
+		}
+		if seq > karmaLogMax {
+			return log.Delete(int2bytes(int(seq - karmaLogMax)))
+		}
+		return nil
+	})
+}
+
+// KarmaScores returns every score on the channel's scoreboard (see karmaBoard), highest first
+func (c *Connection) KarmaScores(channel string) []KarmaScore {
+	var scores []KarmaScore
+	board := c.karmaBoard(channel)
+	err := c.boltdb.View(func(tx *bolt.Tx) error {
+		bucket, err := c.karmaBucket(tx, board)
+		if bucket == nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			scores = append(scores, KarmaScore{Name: string(k), Karma: bytes2int(v)})
+			return nil
+		})
+	})
+	if err != nil {
+		c.Log.Println("karma error:", err)
+	}
+	sort.Sort(byKarma(scores))
+	return scores
+}
+
+type byKarma []KarmaScore
+
+func (s byKarma) Len() int      { return len(s) }
+func (s byKarma) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byKarma) Less(i, j int) bool {
+	if s[i].Karma != s[j].Karma {
+		return s[i].Karma > s[j].Karma
+	}
+	return s[i].Name < s[j].Name
+}
+
+// KarmaLog returns up to n recent events for name, newest first, or for everyone if name is empty
+func (c *Connection) KarmaLog(name string, n int) []KarmaEvent {
+	return c.findKarma(n, func(e KarmaEvent) bool {
+		return name == "" || e.To == name || c.karmaFold(e.To) == name
+	})
+}
+
+// findKarma returns up to n recent events that match, newest first, looking through the whole log
+func (c *Connection) findKarma(n int, match func(e KarmaEvent) bool) []KarmaEvent {
+	var events []KarmaEvent
+	err := c.boltdb.View(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbkarmalog)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && len(events) < n; k, v = cursor.Prev() {
+			var e KarmaEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if match(e) {
+				events = append(events, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.Log.Println("karma log error:", err)
+	}
+	return events
+}
+
+// ago returns a short duration, such as '5m' or '3d'
+func ago(t time.Time) string {
+	d := time.Now().Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%vm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%vh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%vd ago", int(d.Hours()/24))
+}
+
+// commandKarma shows karma:
+//
+//	karma                  your own
+//	karma <nick>           someone else's
+//	karma top|bottom [n]   the leaderboard
+//	karma rank [nick]      place on the leaderboard
+//	karma why [nick]       recent reasons
+//	karma global [nick]    karma in every channel
+//
+// Channels with local karma have their own scoreboard, see karmaBoard.
+func commandKarma(c *Connection, irc *IRC) {
+	args := irc.Arguments
+	name := func(i int) string {
+		if len(args) > i {
+			return args[i]
+		}
+		return irc.ReplyTo
+	}
+	if len(args) == 0 {
+		irc.Reply(c, c.karmaShow(irc.To, irc.ReplyTo))
+		return
+	}
+	switch args[0] {
+	case "top", "bottom":
+		n := 5
+		if len(args) > 1 {
+			if i, err := strconv.Atoi(args[1]); err == nil && i > 0 && i <= 10 {
+				n = i
+			}
+		}
+		scores := c.KarmaScores(irc.To)
+		if args[0] == "bottom" {
+			sort.Sort(sort.Reverse(byKarma(scores)))
+		}
+		if len(scores) > n {
+			scores = scores[:n]
+		}
+		if len(scores) == 0 {
+			irc.Reply(c, "no karma yet")
+			return
+		}
+		var list []string
+		for _, s := range scores {
+			list = append(list, fmt.Sprintf("%s (%v)", s.Name, s.Karma))
+		}
+		irc.Reply(c, fmt.Sprintf("%s karma: %s", args[0], strings.Join(list, ", ")))
+	case "rank":
+		who := name(1)
+		key := c.KarmaName(who)
+		scores := c.KarmaScores(irc.To)
+		for i, s := range scores {
+			if s.Name == key {
+				irc.Reply(c, fmt.Sprintf("%s is #%v of %v with %v karma", who, i+1, len(scores), s.Karma))
+				return
+			}
+		}
+		irc.Reply(c, fmt.Sprintf("%s has no karma yet", who))
+	case "why":
+		who := name(1)
+		key := c.KarmaName(who)
+		local := c.karmaBoard(irc.To) != ""
+		events := c.findKarma(3, func(e KarmaEvent) bool {
+			if e.Reason == "" || local && c.Fold(e.Channel) != c.Fold(irc.To) {
+				return false
+			}
+			return e.To == key || c.karmaFold(e.To) == key
+		})
+		var list []string
+		for _, e := range events {
+			list = append(list, fmt.Sprintf("%+d from %s in %s %s: %s", e.Delta, e.From, e.Channel, ago(e.Time), e.Reason))
+		}
+		if len(list) == 0 {
+			irc.Reply(c, fmt.Sprintf("no reasons for %s's karma", who))
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("%s: %s", who, strings.Join(list, "; ")))
+	case "global":
+		who := name(1)
+		irc.Reply(c, fmt.Sprintf("%s has %v karma in all channels", who, c.GlobalKarma(who)))
+	default:
+		irc.Reply(c, c.karmaShow(irc.To, args[0]))
+	}
+}
+
+// commandMasterKarma manages karma names:
+//
+//	karma alias <nick> <name>   karma for nick goes to name
+//	karma unalias <nick>
+//	karma aliases
+//	karma migrate               merge names from before normalizing, such as 'Alice' and 'alice_'
+func commandMasterKarma(c *Connection, irc *IRC) {
+	args := irc.Arguments
+	switch {
+	case args[0] == "alias" && len(args) == 3:
+		if err := c.SetKarmaAlias(args[1], args[2]); err != nil {
+			irc.Reply(c, err.Error())
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("karma for %s goes to %s", args[1], c.KarmaName(args[2])))
+	case args[0] == "unalias" && len(args) == 2:
+		if err := c.RemoveKarmaAlias(args[1]); err != nil {
+			c.Log.Println("karma error:", err)
+			irc.Reply(c, "error, check logs")
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("karma for %s is its own", args[1]))
+	case args[0] == "aliases" && len(args) == 1:
+		aliases := c.KarmaAliases()
+		if len(aliases) == 0 {
+			irc.Reply(c, "no karma aliases")
+			return
+		}
+		var list []string
+		for alias, name := range aliases {
+			list = append(list, alias+" -> "+name)
+		}
+		sort.Strings(list)
+		irc.Reply(c, strings.Join(list, ", "))
+	case args[0] == "migrate" && len(args) == 1:
+		n, err := c.MigrateKarma()
+		if err != nil {
+			c.Log.Println("karma migrate error:", err)
+			irc.Reply(c, "error, check logs")
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("merged %v karma names", n))
+	default:
+		irc.Reply(c, "usage: "+c.commandPrefix(irc, true)+"karma alias <nick> <name> | unalias <nick> | aliases | migrate")
+	}
+}
@@ -0,0 +1,212 @@
+package ircb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestKarmaLog(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+	for _, line := range []string{
+		":alice!u@h PRIVMSG #chan :bob++ # for fixing CI",
+		":alice!u@h PRIVMSG #chan :carol++",
+		":dave!u@h PRIVMSG #chan :bob++",
+		":dave!u@h PRIVMSG #chan :erin--",
+	} {
+		if !c.parseKarma(Parse(line)) {
+			t.Errorf("%q: not karma", line)
+		}
+	}
+	tc := c.conn.(*testconnection)
+	for _, tt := range []struct {
+		command, expected string
+	}{
+		{"!karma bob", ":2"},
+		{"!karma top 2", "top karma: bob (2), carol (1)"},
+		{"!karma bottom 1", "bottom karma: erin (-1)"},
+		{"!karma rank carol", "carol is #2 of 3 with 1 karma"},
+		{"!karma why bob", "bob: +1 from alice in #chan just now: for fixing CI"},
+		{"!karma why carol", "no reasons for carol's karma"},
+	} {
+		tc.buf.Reset()
+		commandKarma(c, c.config.Parse(":someone!u@h PRIVMSG #chan :"+tt.command))
+		if !strings.Contains(tc.buf.String(), tt.expected) {
+			t.Errorf("%q: expected %q, got %q", tt.command, tt.expected, tc.buf.String())
+		}
+	}
+	if events := c.KarmaLog("", 10); len(events) != 4 || events[0].To != "erin" || events[0].From != "dave" {
+		t.Errorf("got %+v", events)
+	}
+
+	// reasons older than many events are still found
+	for i := 0; i < 150; i++ {
+		if err := c.addKarma(KarmaEvent{From: "erin", To: "bob", Channel: "#chan", Delta: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tc.buf.Reset()
+	commandKarma(c, c.config.Parse(":someone!u@h PRIVMSG #chan :!karma why bob"))
+	if !strings.Contains(tc.buf.String(), "for fixing CI") {
+		t.Errorf("expected old reason, got %q", tc.buf.String())
+	}
+}
+
+func TestKarmaLimits(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+	c.config.KarmaDailyCap = 3
+	now := time.Now()
+	for i, tt := range []struct {
+		from, to string
+		since    time.Duration
+		expected error
+	}{
+		{"Alice", "alice_", 0, ErrSelfKarma},
+		{"alice", "Bob", 0, nil},
+		{"alice", "bob", time.Second, ErrKarmaCooldown},
+		{"alice", "carol", time.Second, nil},
+		{"alice", "BOB", 2 * time.Minute, nil},
+		{"alice", "dave", 3 * time.Minute, ErrKarmaCap},
+		{"erin", "dave", 3 * time.Minute, nil},
+		{"alice", "dave", 25 * time.Hour, nil},
+	} {
+		e := KarmaEvent{Time: now.Add(tt.since), From: tt.from, Giver: c.KarmaName(tt.from), To: c.KarmaName(tt.to), Delta: 1}
+		if err := c.addKarma(e); err != tt.expected {
+			t.Errorf("%v: %s to %s: expected %v, got %v", i, tt.from, tt.to, tt.expected, err)
+		}
+	}
+	if karma := c.karmaShow("", "Bob"); karma != "2" {
+		t.Errorf("expected 2 karma for bob, got %q", karma)
+	}
+
+	// karma goes to the services account
+	c.config.KarmaAccounts = true
+	c.setAccount("frank", "bob")
+	if name := c.KarmaName("frank"); name != "bob" {
+		t.Errorf("expected bob, got %q", name)
+	}
+
+	// + and - inside names are kept
+	c.parseKarma(Parse(":gina!u@h PRIVMSG #chan :g-man++"))
+	if karma := c.karmaShow("", "g-man"); karma != "1" {
+		t.Errorf("expected 1 karma for g-man, got %q", karma)
+	}
+}
+
+func TestKarmaMigrate(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+	// karma from before names were folded
+	c.boltdb.Update(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbkarma)
+		bucket.Put([]byte("Bob"), int2bytes(2))
+		bucket.Put([]byte("bob"), int2bytes(3))
+		bucket.Put([]byte("bob_"), int2bytes(-1))
+		bucket.Put([]byte("carol"), int2bytes(1))
+		bucket.Put([]byte("Robert"), int2bytes(5))
+		return nil
+	})
+	if n, err := c.MigrateKarma(); err != nil || n != 3 {
+		t.Fatalf("expected 3 merged, got %v %v", n, err)
+	}
+	if err := c.SetKarmaAlias("ROBERT", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"BOB": "9", "robert": "9", "carol": "1"} {
+		if karma := c.karmaShow("", name); karma != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, karma)
+		}
+	}
+	if n, err := c.MigrateKarma(); err != nil || n != 0 {
+		t.Errorf("expected nothing to merge, got %v %v", n, err)
+	}
+	if err := c.SetKarmaAlias("bob", "robert"); err == nil {
+		t.Errorf("expected error aliasing bob to itself")
+	}
+}
+
+func TestKarmaOps(t *testing.T) {
+	for _, tt := range []struct {
+		message, expected string
+	}{
+		{"bob++", "bob+1"},
+		{"bob-", "bob-1"},
+		{"bob+ is nice", ""},
+		{"I think bob++ and carol-- today", "bob+1 carol-1"},
+		{"(the build system)++ works again, alice++.", "the build system+1 alice+1"},
+		{"bob: thanks!", "bob+1"},
+		{"ok, bob: many thanks for that", "bob+1"},
+		{"Thanks, bob", ""},
+		{"bob, thx and carol: ty", "bob+1 carol+1"},
+		{"use `i--` in the loop, or `x++`", ""},
+		{"see https://example.com/a++ and www.example.com/b--", ""},
+		{"i like c++ and C++ but not go--", "go-1"},
+		{"x = 1--", ""},
+		{"-- and ++", ""},
+		{"<--", ""},
+		{"-->", ""},
+		{"look <-- here, <++ there", ""},
+		{"(<3)++", "<3+1"},
+		{"let me try: it works", ""},
+	} {
+		var got []string
+		for _, op := range karmaOps(tt.message, DefaultKarmaIgnore) {
+			got = append(got, fmt.Sprintf("%s%+d", op.Name, op.Delta))
+		}
+		if strings.Join(got, " ") != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.message, tt.expected, strings.Join(got, " "))
+		}
+	}
+}
+
+func TestLocalKarma(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+	cc := c.ChannelConfig("#ops")
+	if err := cc.Set("localkarma", "on"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetChannelConfig("#ops", cc); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		":alice!u@h PRIVMSG #ops :bob++ # for the deploy",
+		":carol!u@h PRIVMSG #OPS :bob++",
+		":erin!u@h PRIVMSG #offtopic :bob--",
+		":alice!u@h PRIVMSG #offtopic :dave++ # for the memes",
+	} {
+		if !c.parseKarma(Parse(line)) {
+			t.Errorf("%q: not karma", line)
+		}
+	}
+	tc := c.conn.(*testconnection)
+	for _, tt := range []struct {
+		channel, command, expected string
+	}{
+		{"#ops", "!karma bob", ":2"},
+		{"#offtopic", "!karma bob", ":-1"},
+		{"#ops", "!karma top", "top karma: bob (2)"},
+		{"#offtopic", "!karma top", "top karma: dave (1), bob (-1)"},
+		{"#ops", "!karma why dave", "no reasons for dave's karma"},
+		{"#offtopic", "!karma global bob", "bob has 1 karma in all channels"},
+	} {
+		tc.buf.Reset()
+		commandKarma(c, c.config.Parse(":someone!u@h PRIVMSG "+tt.channel+" :"+tt.command))
+		if !strings.Contains(tc.buf.String(), tt.expected) {
+			t.Errorf("%s %q: expected %q, got %q", tt.channel, tt.command, tt.expected, tc.buf.String())
+		}
+	}
+
+	// aliases and migration apply to local karma too
+	if err := c.SetKarmaAlias("bob", "robert"); err != nil {
+		t.Fatal(err)
+	}
+	if karma := c.karmaShow("#ops", "robert"); karma != "2" {
+		t.Errorf("expected 2 karma for robert in #ops, got %s", karma)
+	}
+}
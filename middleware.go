@@ -0,0 +1,164 @@
+package ircb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a Command, to check something before it runs (or not), or after.
+//
+//	c.AddCommand("roll", commandRoll, ircb.AllowChannels("#games"), ircb.RateLimit(3, time.Minute))
+type Middleware func(next Command) Command
+
+// Chain wraps fn with middleware, the first one runs first
+func Chain(fn Command, mw ...Middleware) Command {
+	for i := len(mw) - 1; i >= 0; i-- {
+		fn = mw[i](fn)
+	}
+	return fn
+}
+
+// masterName is the master nick from Config.Master
+func (c *Connection) masterName() string {
+	return strings.Split(c.config.Master, ":")[0]
+}
+
+// Feature runs the command only if a feature is enabled where it was sent: 'karma', 'define' or 'links'.
+// See Connection.Settings.
+func Feature(name string) Middleware {
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			if !c.Settings(irc.To).feature(name) {
+				irc.ReplyUser(c, name+" is disabled")
+				return
+			}
+			next(c, irc)
+		}
+	}
+}
+
+// AllowChannels runs the command only in the listed channels, not in private messages
+func AllowChannels(channels ...string) Middleware {
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			if !c.IsChannel(irc.To) || !c.inChannels(irc.To, channels) {
+				return
+			}
+			next(c, irc)
+		}
+	}
+}
+
+// DenyChannels runs the command anywhere except the listed channels
+func DenyChannels(channels ...string) Middleware {
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			if c.IsChannel(irc.To) && c.inChannels(irc.To, channels) {
+				return
+			}
+			next(c, irc)
+		}
+	}
+}
+
+// inChannels returns true if channel is one of channels, using the network's casemapping
+func (c *Connection) inChannels(channel string, channels []string) bool {
+	for _, ch := range channels {
+		if c.EqualFold(channel, ch) {
+			return true
+		}
+	}
+	return false
+}
+
+// Args runs the command only with between min and max arguments, max -1 for no limit.
+// Otherwise the sender is told how many are needed.
+func Args(min, max int) Middleware {
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			n := len(irc.Arguments)
+			if n >= min && (max < 0 || n <= max) {
+				next(c, irc)
+				return
+			}
+			var need string
+			switch {
+			case min == max:
+				need = fmt.Sprintf("%v", min)
+			case max < 0:
+				need = fmt.Sprintf("at least %v", min)
+			default:
+				need = fmt.Sprintf("%v to %v", min, max)
+			}
+			irc.Reply(c, fmt.Sprintf("%s: need %s arguments, got %v", irc.Command, need, n))
+		}
+	}
+}
+
+// RateLimit runs the command at most n times per user in each period, more are ignored
+func RateLimit(n int, per time.Duration) Middleware {
+	var lock sync.Mutex
+	runs := make(map[string][]time.Time) // by folded nick
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			now := time.Now()
+			nick := c.Fold(irc.Nick)
+			lock.Lock()
+			// forget old runs
+			for k, times := range runs {
+				for len(times) != 0 && now.Sub(times[0]) >= per {
+					times = times[1:]
+				}
+				if len(times) == 0 {
+					delete(runs, k)
+				} else {
+					runs[k] = times
+				}
+			}
+			if len(runs[nick]) >= n {
+				lock.Unlock()
+				c.Log.Printf("command %q rate limited: %s", irc.Command, irc.Nick)
+				return
+			}
+			runs[nick] = append(runs[nick], now)
+			lock.Unlock()
+			next(c, irc)
+		}
+	}
+}
+
+// Cooldown runs the command at most once per period in each channel (or private message), more are ignored
+func Cooldown(d time.Duration) Middleware {
+	var lock sync.Mutex
+	last := make(map[string]time.Time) // by folded channel or nick
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			now := time.Now()
+			where := c.Fold(irc.Channel)
+			lock.Lock()
+			if now.Sub(last[where]) < d {
+				lock.Unlock()
+				c.Log.Printf("command %q cooling down in %s", irc.Command, irc.Channel)
+				return
+			}
+			last[where] = now
+			lock.Unlock()
+			next(c, irc)
+		}
+	}
+}
+
+// Timing logs how long the command took, if longer than slow (0 to log every run)
+func Timing(slow time.Duration) Middleware {
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			start := time.Now()
+			next(c, irc)
+			if took := time.Now().Sub(start); took >= slow {
+				c.Log.Printf("command %q took %s", irc.Command, took)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	c := NewTestConnection()
+	var got []string
+	mark := func(name string) Middleware {
+		return func(next Command) Command {
+			return func(c *Connection, irc *IRC) {
+				got = append(got, name)
+				next(c, irc)
+			}
+		}
+	}
+
+	Chain(func(c *Connection, irc *IRC) { got = append(got, "command") }, mark("one"), mark("two"))(c, Parse(":a!b@c PRIVMSG #chan :hi"))
+	if expected := "one two command"; strings.Join(got, " ") != expected {
+		t.Errorf("expected %q, got %q", expected, strings.Join(got, " "))
+	}
+
+	for _, tt := range []struct {
+		mw       Middleware
+		input    string
+		expected bool
+	}{
+		{Args(1, 2), ":a!b@c PRIVMSG #chan :one", true},
+		{Args(1, 2), ":a!b@c PRIVMSG #chan :one two three", false},
+		{Args(2, -1), ":a!b@c PRIVMSG #chan :one two three", true},
+		{Args(2, -1), ":a!b@c PRIVMSG #chan :one", false},
+		{AllowChannels("#Chan"), ":a!b@c PRIVMSG #chan :hi", true},
+		{AllowChannels("#chan"), ":a!b@c PRIVMSG #other :hi", false},
+		{AllowChannels("#chan"), ":a!b@c PRIVMSG bot :hi", false},
+		{DenyChannels("#chan"), ":a!b@c PRIVMSG #CHAN :hi", false},
+		{DenyChannels("#chan"), ":a!b@c PRIVMSG bot :hi", true},
+		{RequireRole(RoleUser), ":a!b@c PRIVMSG #chan :hi", true},
+		{RequireRole(RoleOperator), ":a!b@c PRIVMSG #chan :hi", false},
+	} {
+		ran := false
+		irc := Parse(tt.input)
+		irc.Command = "test"
+		irc.Arguments = strings.Fields(irc.Message)
+		Chain(func(c *Connection, irc *IRC) { ran = true }, tt.mw)(c, irc)
+		if ran != tt.expected {
+			t.Errorf("%q: expected %v, got %v", tt.input, tt.expected, ran)
+		}
+	}
+
+	count := 0
+	limited := Chain(func(c *Connection, irc *IRC) { count++ }, RateLimit(2, time.Minute))
+	for i := 0; i < 3; i++ {
+		limited(c, Parse(":a!b@c PRIVMSG #chan :!test"))
+	}
+	limited(c, Parse(":other!b@c PRIVMSG #chan :!test"))
+	if count != 3 {
+		t.Errorf("rate limit: expected 3 runs, got %v", count)
+	}
+}
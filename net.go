@@ -9,7 +9,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,25 +20,56 @@ import (
 var version = "ircb v0.0.9"
 
 // Connection will be divided into:
-// 	Client
-//	Connection
 //
+//	Client
+//	Connection
 type Connection struct {
-	Log        *log.Logger
-	HTTPClient *http.Client       // customize user agent, proxy, tls, redirects, etc
-	CommandMap map[string]Command // map of command names to Command functions
-	MasterMap  map[string]Command // map of master command names to Command functions
-	diamond    *diamond.System    // can be nil
-	config     *Config            // current config
-	boltdb     *bolt.DB           // opened database
-	conn       io.ReadWriteCloser
-	since      time.Time // since connected to server
-	masterauth time.Time // auth and auth timeout
-	reader     *bufio.Reader
-	maplock    sync.Mutex // guards (both) command map writes
-	connected  bool
-	joined     bool
-	quiet      bool
+	Log         *log.Logger
+	HTTPClient  *http.Client       // customize user agent, proxy, tls, redirects, etc
+	CommandMap  map[string]Command // map of command names to Command functions
+	MasterMap   map[string]Command // map of master command names to Command functions
+	ConfigFile  string             // for reloading, see Reload (can be empty to use config.json)
+	diamond     *diamond.System    // can be nil
+	config      *Config            // current config
+	boltdb      *bolt.DB           // opened database
+	bot         *Bot               // can be nil, see Bot
+	events      *events            // see On
+	registry    *Registry          // documented commands, see Register
+	certfps     *certfps           // from WHOIS, see Role
+	accounts    *accounts          // services accounts, see Account
+	chanconfigs *channelConfigs    // see ChannelConfig
+	conn        io.ReadWriteCloser
+	since       time.Time // since connected to server
+	masterauth  time.Time // auth and auth timeout
+	reader      *bufio.Reader
+	maplock     sync.Mutex // guards (both) command map writes
+	connected   bool
+	registered  bool // capability negotiation is over
+	joined      bool
+
+	closelock sync.Mutex    // guards closing and done
+	closing   bool          // Close was called, dont reconnect
+	done      chan struct{} // closed by Close
+	tasks     chan func()   // run on the connection's goroutine, see Do
+	hooklock  sync.Mutex    // guards hooks
+	hooks     hooks         // OnDisconnect and OnReconnect functions
+
+	queue      *sendqueue // outgoing lines, flood controlled
+	writerlock sync.Mutex // guards writing
+	writing    bool       // queue is being sent
+	hostlock   sync.Mutex // guards hostmask
+	hostmask   string     // our own nick!user@host
+	nick       string     // primary nick, config.Nick can be an alternate
+	nicktries  int        // alternate nicks tried
+	chans      *channelState
+	rejoin     []string // channels we were in before reconnecting
+
+	supportlock sync.Mutex // guards isupport
+	isupport    ISupport   // network features
+
+	caplock       sync.Mutex        // guards caps and capsAvailable
+	caps          map[string]string // enabled capabilities
+	capsAvailable map[string]string // capabilities the server has, with values
 }
 
 // NewConnection returns an unconnected client from the given config
@@ -49,13 +79,26 @@ func (config *Config) NewConnection() *Connection {
 	}
 	c := new(Connection)
 	c.config = config
+	c.nick = config.Nick
 	c.since = time.Now()
 
 	// TODO: custom client for user agent, proxy support
 	c.HTTPClient = http.DefaultClient
 	c.HTTPClient.Timeout = time.Second * 3
+	c.queue = newSendQueue(config)
+	c.chans = newChannelState()
+	c.isupport = DefaultISupport()
 	c.CommandMap = DefaultCommandMap()
 	c.MasterMap = DefaultMasterMap()
+	c.registry = DefaultRegistry()
+	c.certfps = newCertFPs()
+	c.accounts = newAccounts()
+	c.chanconfigs = newChannelConfigs()
+	c.tasks = make(chan func())
+	c.events = newEvents()
+	c.On("NOTICE", nickservHandler)
+	c.On("MODE", autojoinHandler)
+	c.On("PRIVMSG", commandHandler)
 	if config.Verbose {
 		c.Log = log.New(os.Stderr, "", log.Lshortfile)
 	} else {
@@ -65,21 +108,33 @@ func (config *Config) NewConnection() *Connection {
 }
 
 func (cfg *Config) dialtls() (*tls.Conn, error) {
-
-	return tls.Dial("tcp", cfg.Host, &tls.Config{
+	tlsconfig := &tls.Config{
 		InsecureSkipVerify: cfg.InvalidSSL,
-	})
+	}
+	// client certificate, for SASL EXTERNAL or CertFP
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsconfig.Certificates = []tls.Certificate{cert}
+	}
+	return tls.Dial("tcp", cfg.Host, tlsconfig)
 }
 
-// Connect dials the host
+// Connect dials the host, reconnecting until Close is called (see Config.Reconnect)
 func (c *Connection) Connect() (err error) {
 	if !c.connected {
 		c.connected = true
+		c.closelock.Lock()
+		c.closing = false
+		c.done = make(chan struct{})
+		c.closelock.Unlock()
 		defer func(c *Connection) {
 			c.connected = false
 			c.Close()
 		}(c)
-		if c.config.Diamond {
+		if c.config.Diamond && c.bot == nil {
 			if c.config.DiamondSocket == "" {
 				c.config.DiamondSocket = "control.socket"
 			}
@@ -94,34 +149,117 @@ func (c *Connection) Connect() (err error) {
 			c.diamond.SetRunlevel(1, func() error { return nil })
 			c.diamond.Runlevel(1)
 		}
-		c.boltdb, err = loadDatabase(c.config.Database)
-		if err != nil {
-			return err
+		if c.bot == nil {
+			// a Bot opens the database for all networks
+			c.boltdb, err = loadDatabase(c.config.Database)
+			if err != nil {
+				return err
+			}
 		}
 
-		// dial direct
 		c.Log.Println(version)
-		c.Log.Println("connecting...")
-		fmt.Printf("%s\n", c.MarshalConfig())
-		if c.config.UseSSL {
-			c.conn, err = c.config.dialtls()
-		} else {
-			c.conn, err = net.Dial("tcp", c.config.Host)
+		if b, err := c.config.redacted().Marshal(); err == nil {
+			fmt.Printf("%s\n", b)
 		}
-		if err != nil {
-			return err
-		}
-		err = c.initialconnect()
-		if err != nil {
-			return err
+		var attempt int
+		for {
+			var registered bool
+			registered, err = c.connect(attempt > 0)
+			if c.isClosing() {
+				return err
+			}
+			c.Log.Println("disconnected:", err)
+			c.disconnected(err)
+			if registered {
+				attempt = 0
+			}
+			attempt++
+			if c.config.Reconnect < 0 ||
+				(c.config.Reconnect > 0 && attempt > c.config.Reconnect) {
+				return err
+			}
+			wait := c.backoff(attempt)
+			c.Log.Printf("reconnecting in %s (attempt %v)", wait, attempt)
+			timer := time.NewTimer(wait)
+		waiting:
+			for {
+				select {
+				case <-timer.C:
+					break waiting
+				case fn := <-c.tasks:
+					fn()
+				case <-c.done:
+					timer.Stop()
+					return err
+				}
+			}
 		}
-
-		c.Log.Println("connected.")
-		return c.readerwriter()
 	}
 	return fmt.Errorf("already connected")
 }
 
+// Do runs fn on the connection's goroutine, between messages, and waits for it.
+// Use it to change what handlers use (such as the config) from another goroutine.
+// Handlers and commands already run there, and must not call Do.
+// Before Connect, or after Close, fn runs right away.
+func (c *Connection) Do(fn func()) {
+	c.closelock.Lock()
+	done, running := c.done, c.done != nil && !c.closing
+	c.closelock.Unlock()
+	if !running || c.tasks == nil {
+		fn()
+		return
+	}
+	ran := make(chan struct{})
+	select {
+	case c.tasks <- func() { fn(); close(ran) }:
+		<-ran
+	case <-done:
+		fn()
+	}
+}
+
+// connect dials, registers and reads until the connection is lost
+// Returns true if registration was completed.
+func (c *Connection) connect(reconnecting bool) (registered bool, err error) {
+	// dial direct
+	c.Log.Println("connecting...")
+	if c.config.UseSSL {
+		c.conn, err = c.config.dialtls()
+	} else {
+		c.conn, err = net.Dial("tcp", c.config.Host)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer c.conn.Close()
+	c.since = time.Now()
+	c.joined = false
+	c.hostmask = ""
+	c.config.Nick = c.nick
+	c.nicktries = 0
+	if rejoin := c.chans.reset(); len(rejoin) != 0 {
+		c.rejoin = rejoin
+	}
+	c.resetISupport()
+	c.accounts.reset()
+	c.scheduleUnmutes()
+	err = c.initialconnect()
+	if err != nil {
+		return false, err
+	}
+
+	c.Log.Println("connected.")
+	stop := c.startWriter()
+	defer stop()
+	stopregain := c.startRegain()
+	defer stopregain()
+	if reconnecting {
+		c.reconnected()
+	}
+	return true, c.readerwriter()
+}
+
 // Diamond returns ircb's diamond system, will be nil if not connected or not configured with 'Diamond: true'
 func (c *Connection) Diamond() *diamond.System {
 	return c.diamond
@@ -133,12 +271,21 @@ func (c *Connection) Database() *bolt.DB {
 }
 
 // Close all connections and databases, remove diamond.socket
+// A closed Connection does not reconnect.
 func (c *Connection) Close() error {
 	if c == nil {
 
 		return nil
 	}
-	if c.boltdb != nil {
+	c.closelock.Lock()
+	if !c.closing {
+		c.closing = true
+		if c.done != nil {
+			close(c.done)
+		}
+	}
+	c.closelock.Unlock()
+	if c.boltdb != nil && c.bot == nil {
 		err1 := c.boltdb.Close()
 		if err1 != nil {
 			c.Log.Println(err1)
@@ -158,6 +305,7 @@ func (c *Connection) Close() error {
 }
 
 // Write to irc connection, adding '\r\n'
+// Once connected, lines are queued and sent at the rate allowed by Config.FloodRate
 func (c *Connection) Write(b []byte) (n int, err error) {
 	if strings.TrimSpace(string(b)) == "" || len(b) < 4 {
 		return 0, fmt.Errorf("write too small")
@@ -166,20 +314,27 @@ func (c *Connection) Write(b []byte) (n int, err error) {
 		b = append(b, "\r\n"...)
 	}
 	str := string(b)
-	if c.quiet && strings.Contains(str, "PRIVMSG") {
-		if c.config.Verbose {
-			c.Log.Println("MUTED:", str)
-		}
-		return
-	}
-
 	if c.config.Verbose {
 		c.Log.Println("SEND", str)
 	}
+	c.writerlock.Lock()
+	writing := c.writing
+	c.writerlock.Unlock()
+	if writing {
+		if !c.queue.push(b) {
+			return 0, ErrQueueFull
+		}
+		return len(b), nil
+	}
 	return c.conn.Write(b)
 }
 
-// MasterCheck sends a private message to NickServ to authenticate master user
+// ErrQueueFull when too many lines are waiting to be sent to one target
+var ErrQueueFull = fmt.Errorf("send queue full")
+
+// MasterCheck sends a private message to NickServ to authenticate master user,
+// the reply is handled by learnAccount. Servers with accounts (account-tag, account-notify, WHOX)
+// do not need this, see Connection.Account.
 //
 // 	-1 no auth mode
 //	0 default, freenode and oragono ACC style
@@ -193,18 +348,16 @@ func (c *Connection) MasterCheck() {
 		c.masterauth = time.Now()
 	default:
 		// freenode and oragono style
-		_, err := c.conn.Write([]byte("" +
-			"PRIVMSG NickServ :ACC " + strings.Split(c.config.Master, ":")[0] + "\r\n"))
+		_, err := c.Write([]byte("PRIVMSG NickServ :ACC " + c.masterName()))
 		if err != nil {
-			c.Log.Printf("auth error: %b", err)
+			c.Log.Printf("auth error: %v", err)
 		}
 
 	case 1:
 		// STATUS style
-		_, err := c.conn.Write([]byte("" +
-			"PRIVMSG NickServ :STATUS " + strings.Split(c.config.Master, ":")[0] + "\r\n"))
+		_, err := c.Write([]byte("PRIVMSG NickServ :STATUS " + c.masterName()))
 		if err != nil {
-			c.Log.Printf("auth error: %b", err)
+			c.Log.Printf("auth error: %v", err)
 		}
 
 	}
@@ -223,58 +376,61 @@ func (c *Connection) SendMaster(format string, i ...interface{}) {
 	c.Send(reply)
 }
 
-// Send IRC message (uses To and Message fields)
+// Send IRC message (uses Verb, To, Message and Tags fields, Verb can be empty for PRIVMSG)
+// Messages to a channel follow its settings: nothing is sent if muted, and at most MaxLines lines.
 func (c *Connection) Send(irc IRC) {
-	irc.Message = strings.TrimSuffix(irc.Message, "\n")
-	if strings.Contains(irc.Message, "\n") {
-		messages := strings.Split(irc.Message, "\n")
-		for _, v := range messages {
-			if strings.TrimSpace(v) == "" {
-				continue
-			}
-
-			line := IRC{
-				To:      irc.To,
-				Message: v,
-			}
-			c.Send(line)
-			<-time.After(time.Second)
-
+	if irc.Tags != nil && !c.HasCapability("message-tags") {
+		irc.Tags = nil
+	}
+	verb := irc.Verb
+	if verb == "" {
+		verb = "PRIVMSG"
+	}
+	maxlines := 0
+	if (verb == "PRIVMSG" || verb == "NOTICE") && c.IsChannel(irc.To) {
+		settings := c.Settings(irc.To)
+		if settings.Muted {
+			c.Log.Printf("muted in %s, not sending: %q", irc.To, irc.Message)
+			return
 		}
-
-		return
+		maxlines = settings.MaxLines
+	}
+	// long lines are split to fit, counting what the server adds
+	var lines []string
+	for _, v := range strings.Split(strings.TrimSuffix(irc.Message, "\n"), "\n") {
+		v = strings.TrimSuffix(v, "\r")
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		lines = append(lines, splitMessage(v, c.lineBudget(verb, irc.To))...)
 	}
-	e := irc.Encode()
-	c.Log.Printf(">%q", string(e))
-	if len(e) < 512 {
+	if maxlines > 0 && len(lines) > maxlines {
+		c.Log.Printf("%v lines to %s, sending %v", len(lines), irc.To, maxlines)
+		lines = lines[:maxlines]
+	}
+	for _, line := range lines {
+		msg := IRC{
+			Verb:    irc.Verb,
+			To:      irc.To,
+			Message: line,
+			Tags:    irc.Tags,
+		}
+		e := msg.Encode()
+		c.Log.Printf(">%q", string(e))
 		_, err := c.Write(e)
 		if err != nil {
 			c.Log.Println(err)
 		}
-		return
-	}
-	var line string
-
-	for i, r := range []rune(irc.Message) {
-		line = line + string(r)
-		if i > 0 && (i+1)%500 == 0 {
-			msg := IRC{
-				To:      irc.To,
-				Message: line,
-			}
-			c.Write(msg.Encode())
-			line = ""
-		}
 	}
 }
 
 func (c *Connection) initialconnect() error {
-	b := make([]byte, 512)
-	_, err := c.conn.Read(b)
+	c.registered = false
+	c.reader = bufio.NewReaderSize(c.conn, 512)
+	negotiating, err := c.capLS()
 	if err != nil {
 		return err
 	}
-	c.Log.Println(string(b))
 	_, err = c.conn.Write([]byte(fmt.Sprintf("NICK %s\r\n", c.config.Nick)))
 	if err != nil {
 		return err
@@ -283,6 +439,12 @@ func (c *Connection) initialconnect() error {
 	if err != nil {
 		return err
 	}
+	if negotiating {
+		if err = c.negotiate(); err != nil {
+			return err
+		}
+	}
+	c.registered = true
 
 	_, err = c.conn.Write([]byte(fmt.Sprintf("MODE %s :%s", c.config.Nick, "+i\r\n")))
 	if err != nil {
@@ -294,7 +456,7 @@ func (c *Connection) initialconnect() error {
 
 // read until read error
 func (c *Connection) readerwriter() error {
-	logfile, err := openlogfile()
+	logfile, err := openlogfile(c.config.Network)
 	if err != nil {
 
 		return err
@@ -307,93 +469,87 @@ func (c *Connection) readerwriter() error {
 	logfile.Sync()
 	c.Log.Println("reading from net")
 	defer c.Log.Println("reader stopping")
-	c.reader = bufio.NewReaderSize(c.conn, 512)
+	// lines are read here, and handled with tasks (see Do) on this goroutine
+	lines := make(chan string)
+	readerr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := c.reader.ReadString('\n')
+			if err != nil {
+				readerr <- err
+				return
+			}
+			lines <- msg
+		}
+	}()
 	for {
-		msg, err := c.reader.ReadString('\n')
-		if err != nil {
+		var msg string
+		select {
+		case fn := <-c.tasks:
+			fn()
+			continue
+		case err := <-readerr:
 			return err
+		case msg = <-lines:
 		}
 		if c.config.Verbose {
 			c.Log.Printf("read: %q", msg)
 			logfile.Sync()
 		}
 
+		// parse
+		cfg := *c.config
+		irc := cfg.parse(msg, c.chanTypes())
+		if irc == nil {
+			continue
+		}
+		// channels can have their own command prefix
+		if irc.Verb == "PRIVMSG" && c.IsChannel(irc.To) {
+			if prefix := c.Settings(irc.To).CommandPrefix; prefix != cfg.CommandPrefix {
+				cfg.CommandPrefix = prefix
+				irc = cfg.parse(msg, c.chanTypes())
+			}
+		}
+
+		c.learnHostmask(irc)
+		c.learnCertFP(irc)
+		c.learnAccount(irc)
+		c.trackChannels(irc)
+
 		// handle PING
-		if strings.HasPrefix(msg, "PING") {
-			pong := []byte(strings.Replace(msg, "PING", "PONG", -1))
-			_, err = c.Write(pong)
+		if irc.Verb == "PING" {
+			pong := IRC{Verb: "PONG", Params: irc.Params}
+			_, err = c.Write(pong.Encode())
 			if err != nil {
 				c.Log.Println(err)
 			}
 			continue
 		}
-		msg = strings.TrimPrefix(msg, ":")
-
-		// parse
-		cfg := *c.config
-		irc := cfg.Parse(msg)
-		// numeric 'verb'
-		if _, err := strconv.Atoi(irc.Verb); err == nil {
-			if verbIntHandler(c, irc) {
-				continue
-			}
-		}
 
+		// core state, before handlers
 		switch irc.Verb {
+		case "NICK":
+			c.nickChange(irc)
+		case "CAP":
+			if _, err := c.capHandler(irc); err != nil {
+				c.Log.Println(err)
+			}
 		default:
-			c.Log.Println("new verb", irc.Verb, irc.Message)
-			if c.config.Verbose {
-				c.Log.Println(irc)
+			if isNumeric(irc.Verb) {
+				verbIntHandler(c, irc)
 			}
-			continue
-		case "QUIT", "PART", "NICK", "JOIN":
-			continue
-		case "NOTICE":
-			// :NickServ!NickServ@services. NOTICE mastername :mustangsally ACC 3
-			switch irc.ReplyTo {
-			case "NickServ":
-				switch c.config.AuthMode {
-				default:
-					if irc.Raw == fmt.Sprintf(formatauth, c.config.Nick, strings.Split(c.config.Master, ":")[0]) {
-						c.masterauth = time.Now()
-					}
-				case -1:
-					c.masterauth = time.Now()
-				case 1:
-					if irc.Message == fmt.Sprintf(formatauth2, strings.Split(c.config.Master, ":")[0]) {
-						c.masterauth = time.Now()
-					}
-
-				}
+		}
 
+		if !c.emit(irc) && !isNumeric(irc.Verb) {
+			switch irc.Verb {
+			case "QUIT", "PART", "JOIN", "KICK", "TOPIC", "NICK", "CAP":
+				// see trackChannels
 			default:
-				c.Log.Println("NOTICE", irc.ReplyTo, irc.Message)
-			}
-
-		case "MODE":
-			c.Log.Printf("NEW MODE: %q", irc.Message)
-			if !c.joined {
-				for _, ch := range strings.Split(c.config.Channels, ",") {
-					if ch != "" {
-						c.Log.Println("Joining channel:", ch)
-						c.Write([]byte(fmt.Sprintf("JOIN %s", ch)))
-					}
-				}
-				c.joined = true
-				c.Log.Println("Starting normal operation")
-				c.SendMaster("hello, master")
-			}
-
-		case "PRIVMSG":
-
-			// maybe master command
-			if irc.ReplyTo == strings.Split(c.config.Master, ":")[0] {
-				if privmsgMasterHandler(c, irc) {
-					continue
+				c.Log.Println("new verb", irc.Verb, irc.Message)
+				if c.config.Verbose {
+					c.Log.Println(irc)
 				}
 			}
-
-			privmsgHandler(c, irc)
 		}
 	}
 }
@@ -0,0 +1,118 @@
+package ircb
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nick returns the nick the bot is using, which can be an alternate while Config.Nick is taken
+func (c *Connection) Nick() string {
+	return c.config.Nick
+}
+
+// nextNick returns the next nick to try, from Config.AltNicks then
+// the primary nick with underscores or a number appended.
+func (c *Connection) nextNick() string {
+	c.nicktries++
+	n := c.nicktries
+	if n <= len(c.config.AltNicks) {
+		return c.config.AltNicks[n-1]
+	}
+	n -= len(c.config.AltNicks)
+	suffix := strings.Repeat("_", n)
+	if n > 2 {
+		suffix = strconv.Itoa(n - 2)
+	}
+	nick := c.nick
+	if max := c.ISupport().NickLen; max > len(suffix) && len(nick)+len(suffix) > max {
+		nick = nick[:max-len(suffix)]
+	}
+	return nick + suffix
+}
+
+// nickError handles 432, 433 and 436 numerics.
+// Before registration, the next nick is tried. After, we were trying to regain our nick.
+func (c *Connection) nickError(irc *IRC) {
+	if len(irc.Params) < 2 {
+		return
+	}
+	if irc.Params[0] != "*" && irc.Params[0] != "" {
+		c.Log.Printf("nick %q: %s", irc.Params[1], irc.Message)
+		return
+	}
+	nick := c.nextNick()
+	c.Log.Printf("nick %q: %s, trying %q", irc.Params[1], irc.Message, nick)
+	c.config.Nick = nick
+	if _, err := c.Write([]byte("NICK " + nick)); err != nil {
+		c.Log.Println(err)
+	}
+}
+
+// nickChange handles NICK messages, keeping Config.Nick current when our nick changes
+func (c *Connection) nickChange(irc *IRC) {
+	if irc.Nick != c.config.Nick || irc.Message == "" {
+		return
+	}
+	c.config.Nick = irc.Message
+	c.hostlock.Lock()
+	if i := strings.IndexByte(c.hostmask, '!'); i != -1 {
+		c.hostmask = irc.Message + c.hostmask[i:]
+	}
+	c.hostlock.Unlock()
+	if c.config.Nick == c.nick {
+		c.Log.Println("regained nick:", c.nick)
+		return
+	}
+	c.Log.Println("nick changed:", c.config.Nick)
+}
+
+// regain tries to get the primary nick back, using NickServ if we have a password
+func (c *Connection) regain() {
+	if c.config.Nick == c.nick {
+		return
+	}
+	if c.config.NickPassword != "" {
+		command := strings.ToUpper(c.config.RegainCommand)
+		if command == "" {
+			command = "REGAIN"
+		}
+		c.Write([]byte("PRIVMSG NickServ :" + command + " " + c.nick + " " + c.config.NickPassword))
+		if command == "REGAIN" {
+			// services change our nick
+			return
+		}
+	}
+	c.Write([]byte("NICK " + c.nick))
+}
+
+// startRegain periodically tries to regain the primary nick, on the connection's goroutine.
+// Call stop when disconnected.
+func (c *Connection) startRegain() (stop func()) {
+	if c.config.NickRegain < 0 {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	every := time.Duration(c.config.NickRegain) * time.Second
+	if every == 0 {
+		every = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// regain uses the nicks, which the reader changes
+				select {
+				case c.tasks <- c.regain:
+				case <-quit:
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() { close(quit) }
+}
@@ -0,0 +1,55 @@
+package ircb
+
+import "testing"
+
+func TestNextNick(t *testing.T) {
+	c := NewTestConnection()
+	c.nick = "sally"
+	c.config.AltNicks = []string{"sal", "sally2"}
+	for _, expected := range []string{"sal", "sally2", "sally_", "sally__", "sally1", "sally2"} {
+		if got := c.nextNick(); got != expected {
+			t.Errorf("try %v: expected %q, got %q", c.nicktries, expected, got)
+		}
+	}
+
+	// cut to NICKLEN
+	c.isupportHandler(Parse(":host.test 005 testing NICKLEN=6 :are supported by this server"))
+	c.nick = "sallyann"
+	c.config.AltNicks = nil
+	c.nicktries = 0
+	for _, expected := range []string{"sally_", "sall__", "sally1"} {
+		if got := c.nextNick(); got != expected {
+			t.Errorf("try %v: expected %q, got %q", c.nicktries, expected, got)
+		}
+	}
+}
+
+func TestNickError(t *testing.T) {
+	c := NewTestConnection()
+	c.nick = "sally"
+	c.config.Nick = "sally"
+	tc := c.conn.(*testconnection)
+
+	// registering
+	c.nickError(Parse(":host.test 433 * sally :Nickname is already in use"))
+	if c.config.Nick != "sally_" || tc.buf.String() != "NICK sally_\r\n" {
+		t.Errorf("expected to try sally_, got %q %q", c.config.Nick, tc.buf.String())
+	}
+
+	// registered, a failed regain
+	tc.buf.Reset()
+	c.nickError(Parse(":host.test 433 sally_ sally :Nickname is already in use"))
+	if c.config.Nick != "sally_" || tc.buf.Len() != 0 {
+		t.Errorf("expected to keep sally_, got %q %q", c.config.Nick, tc.buf.String())
+	}
+
+	c.nickError(Parse(":host.test 432 *"))
+	if c.config.Nick != "sally_" {
+		t.Errorf("short numeric changed nick to %q", c.config.Nick)
+	}
+
+	c.nickChange(Parse(":sally_!u@h NICK :sally"))
+	if c.Nick() != "sally" {
+		t.Errorf("expected to regain sally, got %q", c.Nick())
+	}
+}
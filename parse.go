@@ -1,29 +1,33 @@
 package ircb
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 )
 
-// to compare auth replies
-const formatauth = "" +
-	"NickServ!NickServ@services. NOTICE %s :%s ACC 3" // botname mastername
-
-const formatauth2 = "STATUS %s 1 " // mastername
-
 // IRC is a parsed message received from IRC server
 type IRC struct {
-	Raw       string   // As received
-	Verb      string   // Using 'Verb' because we took 'Command' :)
-	ReplyTo   string   // From user or channel
-	To        string   // can be c.config.Nick
-	Channel   string   // From channel (can be user)
-	IsCommand bool     // Is a public command
-	IsWhisper bool     // Is not from channel
-	Message   string   // Parsed message (can still include command prefix)
-	Command   string   // Parsed command (stripped of command prefix)
-	Arguments []string // Parsed arguments (can be nil)
+	Raw       string            // As received
+	Tags      map[string]string // IRCv3 message tags, unescaped (can be nil)
+	Prefix    string            // Message source, 'nick!user@host' or 'server.name' (can be empty)
+	Nick      string            // Nick (or server name) from prefix
+	User      string            // User from prefix (can be empty)
+	Host      string            // Host from prefix (can be empty)
+	Verb      string            // Using 'Verb' because we took 'Command' :)
+	Params    []string          // All parameters in order, including trailing
+	Trailing  string            // Trailing parameter (after ' :'), also the last of Params
+	ReplyTo   string            // From user or channel
+	To        string            // can be c.config.Nick
+	Channel   string            // From channel (can be user)
+	IsCommand bool              // Is a public command
+	IsWhisper bool              // Is not from channel
+	Message   string            // Parsed message (can still include command prefix)
+	Command   string            // Parsed command (stripped of command prefix)
+	Arguments []string          // Parsed arguments (can be nil)
 
+	trailing bool // last param was sent with ':'
 }
 
 // Encode prepares an IRC message to be sent to server
@@ -33,13 +37,50 @@ type IRC struct {
 //  c.Send(irc)
 //  c.Send(IRC{To:"username", Message:"hello"})
 //
+// If Params is not empty, the full message is encoded (without prefix), see String
+// Tags are also encoded, for example a threaded reply:
+//
+//  c.Send(IRC{To: "##ircb", Message: "hi", Tags: map[string]string{"+draft/reply": msgid}})
+//
 func (irc IRC) Encode() []byte {
-	return []byte(fmt.Sprintf("PRIVMSG %s :%s\r\n", irc.To, irc.Message))
+	if len(irc.Params) == 0 {
+		if irc.Verb == "" {
+			irc.Verb = "PRIVMSG"
+		}
+		irc.Params = []string{irc.To, irc.Message}
+		irc.trailing = true
+	}
+	irc.Prefix = ""
+	return []byte(irc.String() + "\r\n")
+}
+
+// String serializes the message in wire format, without '\r\n'
+//
+// For any valid line, Parse(line).String() == line
+// (tags are written in sorted order)
+func (irc IRC) String() string {
+	var buf bytes.Buffer
+	if len(irc.Tags) != 0 {
+		buf.WriteString("@" + encodeTags(irc.Tags) + " ")
+	}
+	if irc.Prefix != "" {
+		buf.WriteString(":" + irc.Prefix + " ")
+	}
+	buf.WriteString(irc.Verb)
+	for i, p := range irc.Params {
+		buf.WriteByte(' ')
+		if i == len(irc.Params)-1 && (irc.trailing || p == "" ||
+			strings.HasPrefix(p, ":") || strings.Contains(p, " ")) {
+			buf.WriteByte(':')
+		}
+		buf.WriteString(p)
+	}
+	return buf.String()
 }
 
 // ReplyUser doesnt send to #channel, only sends
 func (irc *IRC) ReplyUser(c *Connection, s string) {
-	if strings.Contains(irc.ReplyTo, "#") || strings.TrimSpace(s) == "" {
+	if c.IsChannel(irc.ReplyTo) || strings.TrimSpace(s) == "" {
 		c.Log.Println("should not use ReplyUser for channel")
 		return
 	}
@@ -59,76 +100,275 @@ func (irc *IRC) Reply(c *Connection, s string) {
 		To:      irc.ReplyTo,
 		Message: s,
 	}
-	if strings.HasPrefix(irc.To, "#") {
+	if c.IsChannel(irc.To) {
+		reply.To = irc.To
+	}
+	c.Send(reply)
+}
+
+// ReplyThread is like Reply, but tags the reply with '+draft/reply'
+// so that clients can show it as a reply to the original message
+func (irc *IRC) ReplyThread(c *Connection, s string) {
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+	reply := IRC{
+		To:      irc.ReplyTo,
+		Message: s,
+	}
+	if c.IsChannel(irc.To) {
 		reply.To = irc.To
 	}
+	if msgid := irc.Tags["msgid"]; msgid != "" {
+		reply.Tags = map[string]string{"+draft/reply": msgid}
+	}
 	c.Send(reply)
 }
 
+// channel types, before the server tells us otherwise
+const defaultChanTypes = "#&"
+
 // Parse input string into IRC struct. To parse fully, use config method cfg.Parse(input string)
-// 	:Name COMMAND parameter list
-// Where list could begin with ':', which states the rest of list is just one item
-// Sending, we use this format:
-//	:COMMAND argument :string\r\n
-//	:PRIVMSG ##ircb :hello world\r\n
+//
+//	[':' prefix ' '] command [params] [' :' trailing]
+//
+// Where prefix is 'nick!user@host' or 'server.name',
+// and trailing is the last param, which may contain spaces and colons:
+//
+//	:nick!user@host PRIVMSG ##ircb :hello: world
+//	:server.name 433 * nick :Nickname is already in use
+//
+// Messages may also start with IRCv3 tags, '@key=value;key2 ', see Tags
+//
+//	@time=2017-01-01T00:00:00.000Z;msgid=abc :nick!user@host PRIVMSG ##ircb :hello
 func Parse(input string) *IRC {
-	input = strings.TrimSpace(input)
+	return parse(input, defaultChanTypes)
+}
+
+// parse with the network's channel types, see ISupport
+func parse(input string, chantypes string) *IRC {
+	input = strings.TrimLeft(strings.TrimRight(input, "\r\n"), " ")
 	if input == "" {
 		return nil
 	}
 	var irc = new(IRC)
 	irc.Raw = input
-	input = strings.TrimPrefix(input, ":")
-	// split input by spaces
-	s := strings.Split(input, " ")
-	switch len(s) {
-
-	case 1:
-		// for receiving
-		irc.Verb = s[0]
-		// for sending
-		irc.Message = s[0]
-		return irc
-	case 2:
-		irc.Message = s[1]
-		// for receiving
-		irc.Verb = s[0]
-		// for sending
-		irc.To = s[0]
-		return irc
-	case 3:
-		irc.ReplyTo = strings.Split(s[0], "!")[0]
-		irc.Channel = s[0]
-		irc.Verb = s[1]
-		irc.To = s[2]
-		return irc
-	default:
-		irc.ReplyTo = strings.Split(s[0], "!")[0]
-		irc.Channel = s[3]
-		irc.Verb = s[1]
-		irc.To = s[2]
-		irc.Channel = s[3]
-		irc.Message = s[3]
-		if len(s) > 4 {
-			// extract message
-			for i, v := range s[4:] {
-				if strings.HasPrefix(v, ":") {
-					// message has colon prefix which marks the end of tokens
-					irc.Message += " " + strings.Join(s[i+4:], " ")
-					break
-				}
-				irc.Message += " " + v
-			}
-		}
-		irc.Message = strings.TrimPrefix(irc.Message, ":")
+
+	// tags
+	if input[0] == '@' {
+		i := strings.IndexByte(input, ' ')
+		if i == -1 {
+			return nil
+		}
+		irc.Tags = parseTags(input[1:i])
+		input = strings.TrimLeft(input[i+1:], " ")
+		if input == "" {
+			return nil
+		}
+	}
+
+	// prefix
+	if input[0] == ':' {
+		i := strings.IndexByte(input, ' ')
+		if i == -1 {
+			irc.Prefix = input[1:]
+			input = ""
+		} else {
+			irc.Prefix = input[1:i]
+			input = input[i+1:]
+		}
+		irc.Nick, irc.User, irc.Host = splitPrefix(irc.Prefix)
+	}
+
+	// command
+	input = strings.TrimLeft(input, " ")
+	if i := strings.IndexByte(input, ' '); i != -1 {
+		irc.Verb, input = input[:i], input[i+1:]
+	} else {
+		irc.Verb, input = input, ""
 	}
+
+	// params
+	for {
+		input = strings.TrimLeft(input, " ")
+		if input == "" {
+			break
+		}
+		if input[0] == ':' {
+			irc.Trailing = input[1:]
+			irc.Params = append(irc.Params, irc.Trailing)
+			irc.trailing = true
+			break
+		}
+		i := strings.IndexByte(input, ' ')
+		if i == -1 {
+			irc.Params = append(irc.Params, input)
+			break
+		}
+		irc.Params = append(irc.Params, input[:i])
+		input = input[i+1:]
+	}
+
+	irc.fill(chantypes)
 	return irc
 }
 
+// parseTags parses 'key=value;key2' into a map, unescaping values
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+			continue
+		}
+		tags[kv[0]] = unescapeTag(kv[1])
+	}
+	return tags
+}
+
+// encodeTags encodes tags, in sorted order, escaping values
+func encodeTags(tags map[string]string) string {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if v := tags[k]; v != "" {
+			keys[i] = k + "=" + escapeTag(v)
+		}
+	}
+	return strings.Join(keys, ";")
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// escapeTag escapes a tag value for sending
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+// unescapeTag unescapes a received tag value
+// Unknown escapes drop the backslash, a trailing backslash is dropped.
+func unescapeTag(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			break
+		}
+		switch s[i] {
+		case ':':
+			buf.WriteByte(';')
+		case 's':
+			buf.WriteByte(' ')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'n':
+			buf.WriteByte('\n')
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+// splitPrefix splits 'nick!user@host' into its parts
+func splitPrefix(prefix string) (nick, user, host string) {
+	nick = prefix
+	if i := strings.IndexByte(nick, '@'); i != -1 {
+		nick, host = nick[:i], nick[i+1:]
+	}
+	if i := strings.IndexByte(nick, '!'); i != -1 {
+		nick, user = nick[:i], nick[i+1:]
+	}
+	return nick, user, host
+}
+
+// isNumeric returns true for three digit server replies
+func isNumeric(verb string) bool {
+	if len(verb) != 3 {
+		return false
+	}
+	for _, r := range verb {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// fill the convenience fields from the parsed prefix, verb and params
+func (irc *IRC) fill(chantypes string) {
+	ischan := func(s string) bool {
+		return s != "" && strings.IndexByte(chantypes, s[0]) != -1
+	}
+	// numeric replies are from a server, nobody to reply to
+	if !isNumeric(irc.Verb) {
+		irc.ReplyTo = irc.Nick
+	}
+	if len(irc.Params) > 0 {
+		irc.To = irc.Params[0]
+		irc.Message = irc.Params[len(irc.Params)-1]
+	}
+	if irc.trailing {
+		irc.Message = irc.Trailing
+	}
+	irc.Channel = ""
+	switch irc.Verb {
+	case "PRIVMSG", "NOTICE":
+		if ischan(irc.To) {
+			irc.Channel = irc.To
+		} else {
+			// whisper
+			irc.Channel = irc.ReplyTo
+		}
+		return
+	case "INVITE":
+		// :nick INVITE bot #channel
+		if len(irc.Params) > 1 {
+			irc.Channel = irc.Params[1]
+		}
+		return
+	}
+	// first param that looks like a channel
+	// JOIN #chan, KICK #chan nick, 353 bot = #chan :names
+	for _, p := range irc.Params {
+		if ischan(p) {
+			irc.Channel = p
+			return
+		}
+	}
+}
+
 // Parse a command in context of nickname, command prefix
 // Does not handle master command parsing
 func (cfg Config) Parse(input string) *IRC {
-	irc := Parse(input)
+	return cfg.parse(input, defaultChanTypes)
+}
+
+func (cfg Config) parse(input string, chantypes string) *IRC {
+	irc := parse(input, chantypes)
+	if irc == nil {
+		return nil
+	}
 	if cfg.Verbose {
 		fmt.Println("definitely parsing:", irc)
 	}
@@ -2,8 +2,11 @@ package ircb
 
 import (
 	"bytes"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -36,14 +39,41 @@ func NewTestConnection() *Connection {
 	var tc = new(testconnection)
 	tc.buf = new(bytes.Buffer)
 	tc.log = log.New(os.Stderr, "testnet:", log.Lshortfile)
+	// a copy, so tests can change it
+	config := *testconfig
 	return &Connection{
-		Log:    log.New(os.Stderr, "conn:", log.Lshortfile),
-		conn:   tc,
-		config: testconfig,
+		Log:         log.New(os.Stderr, "conn:", log.Lshortfile),
+		conn:        tc,
+		config:      &config,
+		chans:       newChannelState(),
+		isupport:    DefaultISupport(),
+		events:      newEvents(),
+		registry:    DefaultRegistry(),
+		certfps:     newCertFPs(),
+		accounts:    newAccounts(),
+		chanconfigs: newChannelConfigs(),
 	}
 
 }
 
+// newDatabaseTestConnection is NewTestConnection with a database, done closes and removes it
+func newDatabaseTestConnection(t *testing.T) (*Connection, func()) {
+	dir, err := ioutil.TempDir("", "ircb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTestConnection()
+	c.boltdb, err = loadDatabase(filepath.Join(dir, "bolt.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.boltdb.Close()
+		os.RemoveAll(dir)
+	}
+}
+
 func TestTest(t *testing.T) {
 	_, err := NewTestConnection().Write([]byte("PING"))
 	if err != nil {
@@ -55,7 +85,7 @@ func TestTest(t *testing.T) {
 func TestParse(t *testing.T) {
 	c := NewTestConnection()
 	c.config.CommandPrefix = "!"
-	irc := c.config.Parse("foo PRIVMSG :bar")
+	irc := c.config.Parse(":foo PRIVMSG :bar")
 	if irc.Verb != "PRIVMSG" {
 		t.Logf("expected verb: PRIVMSG, got %q", irc.Verb)
 		t.Fail()
@@ -73,29 +103,139 @@ func TestParse(t *testing.T) {
 		{"433", ":host.test 433 * mustangsally :Nickname is already in use\r\n"},
 		{"451", ":oragono.test 451 * :You need to register before you can use that command\r\n"},
 		{"PING", "PING mustangsally\r\n"},
-		{"PRIVMSG", "mustangsally!ok@ok PRIVMSG #ok :hello"},
+		{"PRIVMSG", ":mustangsally!ok@ok PRIVMSG #ok :hello"},
 	}
 
 	for _, test := range testcases {
 		if out := testconfig.Parse(test.input).Verb; out != test.expected {
 			t.Logf("wanted: %q", test.expected)
 			t.Logf("but got: %q", out)
+			t.Fail()
 		}
 	}
 	testcases = []struct {
 		expected, input string
 	}{
-		{"mustangsally :Nickname is already in use", ":host.test 433 * mustangsally :Nickname is already in use\r\n"},
+		{"Nickname is already in use", ":host.test 433 * mustangsally :Nickname is already in use\r\n"},
 		{"You need to register before you can use that command", ":oragono.test 451 * :You need to register before you can use that command\r\n"},
 		{"mustangsally", "PING mustangsally\r\n"},
-		{"hello", "mustangsally!ok@ok PRIVMSG #ok :hello"},
+		{"hello", ":mustangsally!ok@ok PRIVMSG #ok :hello"},
+		{"hello: world :)", ":mustangsally!ok@ok PRIVMSG #ok :hello: world :)"},
 	}
 
 	for _, test := range testcases {
 		if out := testconfig.Parse(test.input).Message; out != test.expected {
 			t.Logf("wanted: %q", test.expected)
 			t.Logf("but got: %q", out)
+			t.Fail()
 		}
 	}
 
 }
+
+func TestParseFields(t *testing.T) {
+	testcases := []struct {
+		input                string
+		nick, user, host     string
+		verb                 string
+		params               []string
+		replyto, to, channel string
+	}{
+		{":nick!user@host PRIVMSG #ok :hello world", "nick", "user", "host", "PRIVMSG",
+			[]string{"#ok", "hello world"}, "nick", "#ok", "#ok"},
+		{":nick!user@host PRIVMSG testing :hi", "nick", "user", "host", "PRIVMSG",
+			[]string{"testing", "hi"}, "nick", "testing", "nick"},
+		{":nick!user@host JOIN #ok", "nick", "user", "host", "JOIN",
+			[]string{"#ok"}, "nick", "#ok", "#ok"},
+		{":nick!user@host JOIN :#ok", "nick", "user", "host", "JOIN",
+			[]string{"#ok"}, "nick", "#ok", "#ok"},
+		{":op!user@host KICK #ok victim :bye: now", "op", "user", "host", "KICK",
+			[]string{"#ok", "victim", "bye: now"}, "op", "#ok", "#ok"},
+		{":nick!user@host INVITE testing :&local", "nick", "user", "host", "INVITE",
+			[]string{"testing", "&local"}, "nick", "testing", "&local"},
+		{":host.test 353 testing = #ok :@op +voice user", "host.test", "", "", "353",
+			[]string{"testing", "=", "#ok", "@op +voice user"}, "", "testing", "#ok"},
+		{":host.test 001 testing :Welcome", "host.test", "", "", "001",
+			[]string{"testing", "Welcome"}, "", "testing", ""},
+		{"PING :host.test", "", "", "", "PING",
+			[]string{"host.test"}, "", "host.test", ""},
+	}
+	for _, test := range testcases {
+		irc := Parse(test.input)
+		got := []string{irc.Nick, irc.User, irc.Host, irc.Verb, irc.ReplyTo, irc.To, irc.Channel}
+		want := []string{test.nick, test.user, test.host, test.verb, test.replyto, test.to, test.channel}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%q: wanted %q, got %q", test.input, want, got)
+		}
+		if strings.Join(irc.Params, ",") != strings.Join(test.params, ",") {
+			t.Errorf("%q: wanted params %q, got %q", test.input, test.params, irc.Params)
+		}
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, line := range []string{
+		"PING :host.test",
+		"PING host.test",
+		":nick!user@host PRIVMSG #ok :hello: world",
+		":nick!user@host PRIVMSG #ok :",
+		":nick!user@host PRIVMSG #ok ::)",
+		":nick!user@host JOIN #ok",
+		":nick!user@host JOIN :#ok",
+		":op!user@host KICK #ok victim :reason",
+		":host.test 353 testing = #ok :@op +voice user",
+		":host.test 005 testing CHANTYPES=#& PREFIX=(ov)@+ :are supported by this server",
+	} {
+		if out := Parse(line).String(); out != line {
+			t.Errorf("wanted %q, got %q", line, out)
+		}
+	}
+
+	// built by hand
+	irc := IRC{Verb: "KICK", Params: []string{"#ok", "victim", "bad bot"}}
+	if out := string(irc.Encode()); out != "KICK #ok victim :bad bot\r\n" {
+		t.Errorf("got %q", out)
+	}
+	irc = IRC{To: "#ok", Message: "hello"}
+	if out := string(irc.Encode()); out != "PRIVMSG #ok :hello\r\n" {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	line := `@time=2017-01-01T00:00:00.000Z;msgid=abc;account=nick;+draft/x=a\:b\sc\\d;flag :nick!user@host PRIVMSG #ok :hello`
+	irc := Parse(line)
+	if irc.Verb != "PRIVMSG" || irc.Nick != "nick" || irc.Message != "hello" {
+		t.Fatalf("bad parse: %#v", irc)
+	}
+	want := map[string]string{
+		"time":     "2017-01-01T00:00:00.000Z",
+		"msgid":    "abc",
+		"account":  "nick",
+		"+draft/x": `a;b c\d`,
+		"flag":     "",
+	}
+	if len(irc.Tags) != len(want) {
+		t.Errorf("wanted %d tags, got %d", len(want), len(irc.Tags))
+	}
+	for k, v := range want {
+		if got, ok := irc.Tags[k]; !ok || got != v {
+			t.Errorf("tag %q: wanted %q, got %q", k, v, got)
+		}
+	}
+
+	// unknown escapes and trailing backslash
+	if out := unescapeTag(`a\bc\`); out != "abc" {
+		t.Errorf("got %q", out)
+	}
+
+	// sorted on the way out
+	if out := Parse(line).String(); out != `@+draft/x=a\:b\sc\\d;account=nick;flag;msgid=abc;time=2017-01-01T00:00:00.000Z :nick!user@host PRIVMSG #ok :hello` {
+		t.Errorf("got %q", out)
+	}
+
+	reply := IRC{To: "#ok", Message: "hi", Tags: map[string]string{"+draft/reply": "abc"}}
+	if out := string(reply.Encode()); out != "@+draft/reply=abc PRIVMSG #ok :hi\r\n" {
+		t.Errorf("got %q", out)
+	}
+}
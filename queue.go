@@ -0,0 +1,264 @@
+package ircb
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority of an outgoing line, lower priorities are sent first
+const (
+	PriorityHigh   = iota // PONG, registration and authentication, including NickServ
+	PriorityNormal        // JOIN, PART, MODE, WHO and anything else
+	PriorityLow           // PRIVMSG and NOTICE, fair between targets
+)
+
+// QueueStats is a snapshot of the outgoing queue, see Connection.QueueStats
+type QueueStats struct {
+	Depth   int    // lines waiting to be sent
+	Targets int    // channels and users with lines waiting
+	Sent    uint64 // lines sent since start
+	Dropped uint64 // lines dropped, because a queue was full or on disconnect
+}
+
+// sendqueue holds outgoing lines until the token bucket allows them to be sent
+type sendqueue struct {
+	mu      sync.Mutex
+	signal  chan struct{} // something was pushed
+	high    [][]byte
+	normal  [][]byte
+	low     map[string][][]byte // lines by target
+	targets []string            // round robin order of low targets
+	max     int                 // max lines per low target, and of high and normal
+	depth   int
+	sent    uint64
+	dropped uint64
+
+	tokens float64   // lines that can be sent right now
+	burst  float64   // max tokens
+	rate   float64   // tokens per second, 0 for no limit
+	last   time.Time // last refill
+}
+
+func newSendQueue(config *Config) *sendqueue {
+	q := &sendqueue{
+		signal: make(chan struct{}, 1),
+		low:    make(map[string][][]byte),
+	}
+	q.configure(config)
+	q.tokens = q.burst
+	q.last = time.Now()
+	return q
+}
+
+// configure sets the limits from config, see Config.FloodRate
+func (q *sendqueue) configure(config *Config) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.max = config.FloodQueue
+	q.burst = float64(config.FloodBurst)
+	q.rate = config.FloodRate
+	if q.max <= 0 {
+		q.max = 50
+	}
+	if q.burst <= 0 {
+		q.burst = 5
+	}
+	if q.rate < 0 {
+		q.rate = 0
+	} else if q.rate == 0 {
+		q.rate = 0.5
+	}
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+}
+
+// classify returns priority and target of an outgoing line
+func classify(b []byte) (priority int, target string) {
+	irc := Parse(string(b))
+	if irc == nil {
+		return PriorityNormal, ""
+	}
+	switch strings.ToUpper(irc.Verb) {
+	case "PONG", "PING", "CAP", "AUTHENTICATE", "PASS", "NICK", "USER", "QUIT":
+		return PriorityHigh, ""
+	case "PRIVMSG", "NOTICE":
+		if strings.EqualFold(irc.To, "NickServ") {
+			return PriorityHigh, ""
+		}
+		return PriorityLow, strings.ToLower(irc.To)
+	default:
+		return PriorityNormal, ""
+	}
+}
+
+// push a line, returning false if it was dropped
+func (q *sendqueue) push(b []byte) bool {
+	priority, target := classify(b)
+	q.mu.Lock()
+	full := false
+	switch priority {
+	case PriorityHigh:
+		if full = len(q.high) >= q.max; !full {
+			q.high = append(q.high, b)
+		}
+	case PriorityNormal:
+		if full = len(q.normal) >= q.max; !full {
+			q.normal = append(q.normal, b)
+		}
+	default:
+		lines, ok := q.low[target]
+		if full = len(lines) >= q.max; !full {
+			if !ok {
+				q.targets = append(q.targets, target)
+			}
+			q.low[target] = append(lines, b)
+		}
+	}
+	if full {
+		q.dropped++
+		q.mu.Unlock()
+		return false
+	}
+	q.depth++
+	q.mu.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next returns the line to send, or how long until a token is available (see take).
+// A PONG doesn't wait, or a slow queue would get us disconnected for a ping timeout.
+func (q *sendqueue) next() (b []byte, wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.depth == 0 {
+		return nil, 0
+	}
+	if len(q.high) == 0 || !strings.HasPrefix(string(q.high[0]), "PONG ") {
+		if wait := q.take(); wait > 0 {
+			return nil, wait
+		}
+	}
+	return q.pop(), 0
+}
+
+// pop the next line to send, by priority then round robin between targets. q.mu must be held.
+func (q *sendqueue) pop() []byte {
+	var b []byte
+	switch {
+	case len(q.high) != 0:
+		b, q.high = q.high[0], q.high[1:]
+	case len(q.normal) != 0:
+		b, q.normal = q.normal[0], q.normal[1:]
+	case len(q.targets) != 0:
+		target := q.targets[0]
+		lines := q.low[target]
+		b = lines[0]
+		q.targets = q.targets[1:]
+		if len(lines) > 1 {
+			q.low[target] = lines[1:]
+			q.targets = append(q.targets, target)
+		} else {
+			delete(q.low, target)
+		}
+	default:
+		return nil
+	}
+	q.depth--
+	q.sent++
+	return b
+}
+
+// len returns the number of lines waiting
+func (q *sendqueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// clear drops all waiting lines
+func (q *sendqueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dropped += uint64(q.depth)
+	q.high, q.normal, q.targets, q.depth = nil, nil, nil, 0
+	q.low = make(map[string][][]byte)
+}
+
+// take a token, or return how long until one is available. q.mu must be held.
+func (q *sendqueue) take() time.Duration {
+	if q.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	q.last = now
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+	if q.tokens >= 1 {
+		q.tokens--
+		return 0
+	}
+	return time.Duration((1 - q.tokens) / q.rate * float64(time.Second))
+}
+
+// QueueStats returns the state of the outgoing queue
+func (c *Connection) QueueStats() QueueStats {
+	if c.queue == nil {
+		return QueueStats{}
+	}
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	return QueueStats{
+		Depth:   c.queue.depth,
+		Targets: len(c.queue.targets),
+		Sent:    c.queue.sent,
+		Dropped: c.queue.dropped,
+	}
+}
+
+// startWriter starts sending queued lines to the server, call stop when disconnected
+func (c *Connection) startWriter() (stop func()) {
+	c.queue.clear()
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	conn := c.conn
+	go func() {
+		defer close(done)
+		for {
+			b, wait := c.queue.next()
+			if b == nil {
+				var timeout <-chan time.Time
+				if wait > 0 {
+					timeout = time.After(wait)
+				}
+				// a PONG can be pushed while waiting for a token
+				select {
+				case <-timeout:
+				case <-c.queue.signal:
+				case <-quit:
+					return
+				}
+				continue
+			}
+			if _, err := conn.Write(b); err != nil {
+				c.Log.Println("write error:", err)
+			}
+		}
+	}()
+	c.writerlock.Lock()
+	c.writing = true
+	c.writerlock.Unlock()
+	return func() {
+		c.writerlock.Lock()
+		c.writing = false
+		c.writerlock.Unlock()
+		close(quit)
+		<-done
+	}
+}
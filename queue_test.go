@@ -0,0 +1,75 @@
+package ircb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue(&Config{FloodQueue: 2, FloodRate: -1})
+	for _, line := range []string{
+		"PRIVMSG #a :1", "PRIVMSG #a :2", "PRIVMSG #a :dropped", "PRIVMSG bob :1",
+		"MODE #a +o bob", "PRIVMSG NickServ :IDENTIFY hunter2", "PRIVMSG #b :1",
+		"JOIN #c", "WHO #c", "PART #d", "PONG :host.test",
+	} {
+		q.push([]byte(line))
+	}
+	var sent []string
+	for {
+		b, _ := q.next()
+		if b == nil {
+			break
+		}
+		sent = append(sent, string(b))
+	}
+	expected := []string{
+		"PRIVMSG NickServ :IDENTIFY hunter2", "PONG :host.test",
+		"MODE #a +o bob", "JOIN #c",
+		"PRIVMSG #a :1", "PRIVMSG bob :1", "PRIVMSG #b :1", "PRIVMSG #a :2",
+	}
+	if len(sent) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, sent)
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Errorf("line %v: expected %q, got %q", i, expected[i], sent[i])
+		}
+	}
+	stats := (&Connection{queue: q}).QueueStats()
+	if stats.Depth != 0 || stats.Sent != 8 || stats.Dropped != 3 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestSendQueueTokens(t *testing.T) {
+	q := newSendQueue(&Config{FloodBurst: 2, FloodRate: 1})
+	for i := 0; i < 3; i++ {
+		q.push([]byte("PRIVMSG #a :hi"))
+	}
+	for i := 0; i < 2; i++ {
+		if b, wait := q.next(); b == nil || wait != 0 {
+			t.Fatalf("burst %v: got %q %v", i, b, wait)
+		}
+	}
+	b, wait := q.next()
+	if b != nil || wait <= 0 || wait > time.Second {
+		t.Fatalf("expected to wait for a token, got %q %v", b, wait)
+	}
+
+	// a PONG doesn't wait
+	q.push([]byte("PONG :host.test"))
+	if b, wait := q.next(); string(b) != "PONG :host.test" || wait != 0 {
+		t.Errorf("expected PONG, got %q %v", b, wait)
+	}
+
+	// refill, up to the burst
+	q.mu.Lock()
+	q.last = q.last.Add(-10 * time.Second)
+	q.mu.Unlock()
+	if b, wait := q.next(); b == nil || wait != 0 {
+		t.Fatalf("expected a refilled token, got %q %v", b, wait)
+	}
+	if q.len() != 0 || q.tokens < 0.9 || q.tokens > 1.1 {
+		t.Errorf("expected one token left, got %v (depth %v)", q.tokens, q.len())
+	}
+}
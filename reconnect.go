@@ -0,0 +1,74 @@
+package ircb
+
+import (
+	"math/rand"
+	"time"
+)
+
+// hooks are called on connection events, in the order they were added
+type hooks struct {
+	disconnect []func(c *Connection, err error)
+	reconnect  []func(c *Connection)
+}
+
+// OnDisconnect adds a function to be called when the server connection is lost.
+// The database and command maps stay open, Connect will try to reconnect.
+func (c *Connection) OnDisconnect(fn func(c *Connection, err error)) {
+	c.hooklock.Lock()
+	defer c.hooklock.Unlock()
+	c.hooks.disconnect = append(c.hooks.disconnect, fn)
+}
+
+// OnReconnect adds a function to be called after reconnecting and registering
+func (c *Connection) OnReconnect(fn func(c *Connection)) {
+	c.hooklock.Lock()
+	defer c.hooklock.Unlock()
+	c.hooks.reconnect = append(c.hooks.reconnect, fn)
+}
+
+func (c *Connection) disconnected(err error) {
+	c.hooklock.Lock()
+	fns := c.hooks.disconnect
+	c.hooklock.Unlock()
+	for _, fn := range fns {
+		fn(c, err)
+	}
+}
+
+func (c *Connection) reconnected() {
+	c.hooklock.Lock()
+	fns := c.hooks.reconnect
+	c.hooklock.Unlock()
+	for _, fn := range fns {
+		fn(c)
+	}
+}
+
+// isClosing returns true if Close has been called
+func (c *Connection) isClosing() bool {
+	c.closelock.Lock()
+	defer c.closelock.Unlock()
+	return c.closing
+}
+
+// backoff returns how long to wait before reconnect attempt n (starting at 1), see reconnectWait, with jitter
+func (c *Connection) backoff(n int) time.Duration {
+	wait := reconnectWait(n, time.Duration(c.config.ReconnectWait)*time.Second)
+	// somewhere between half and all of it
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// reconnectWait doubles from 2 seconds for each attempt n (starting at 1), up to max (0 for 5 minutes)
+func reconnectWait(n int, max time.Duration) time.Duration {
+	if max <= 0 {
+		max = 300 * time.Second
+	}
+	wait := 2 * time.Second
+	for i := 1; i < n && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
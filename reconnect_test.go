@@ -0,0 +1,38 @@
+package ircb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectWait(t *testing.T) {
+	for _, tt := range []struct {
+		n        int
+		max      time.Duration
+		expected time.Duration
+	}{
+		{1, 0, 2 * time.Second},
+		{2, 0, 4 * time.Second},
+		{3, 0, 8 * time.Second},
+		{8, 0, 256 * time.Second},
+		{9, 0, 300 * time.Second},
+		{1000, 0, 300 * time.Second},
+		{0, time.Minute, 2 * time.Second},
+		{5, time.Minute, 32 * time.Second},
+		{6, time.Minute, time.Minute},
+		{2, time.Second, time.Second},
+		{3, -time.Second, 8 * time.Second},
+	} {
+		if wait := reconnectWait(tt.n, tt.max); wait != tt.expected {
+			t.Errorf("attempt %v up to %s: expected %s, got %s", tt.n, tt.max, tt.expected, wait)
+		}
+	}
+
+	c := NewTestConnection()
+	c.config.ReconnectWait = 60
+	for i := 0; i < 100; i++ {
+		if wait := c.backoff(6); wait < 30*time.Second || wait > time.Minute {
+			t.Fatalf("jitter out of range: %s", wait)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package ircb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CommandSpec is a documented command, see Connection.Register
+//
+//	c.Register(ircb.CommandSpec{
+//		Name:     "roll",
+//		Aliases:  []string{"dice"},
+//		Summary:  "roll some dice",
+//		Usage:    "[count] [sides]",
+//		Examples: []string{"2 6"},
+//		MaxArgs:  2,
+//		Category: "games",
+//		Fn:       commandRoll,
+//	})
+type CommandSpec struct {
+	Name       string
+	Aliases    []string     // other names that run the command
+	Summary    string       // one line description
+	Usage      string       // arguments, such as '<word> <text>' or '[nick]'
+	Examples   []string     // arguments, such as 'ircb a bot'
+	MinArgs    int          // min arguments, 0 for none
+	MaxArgs    int          // max arguments, 0 for no limit
+	Hidden     bool         // not listed in help or docs
+	Category   string       // such as 'karma', for grouping in docs
+	Master     bool         // master command, see Config.Master
+	Role       Role         // needed to run, 0 for the default (user, or admin for master commands)
+	Fn         Command      // the command
+	Middleware []Middleware // run before Fn, after the argument check
+}
+
+// Command returns Fn, wrapped with the argument check and Middleware
+func (spec CommandSpec) Command() Command {
+	mw := spec.Middleware
+	if spec.MinArgs > 0 || spec.MaxArgs > 0 {
+		mw = append([]Middleware{spec.checkArgs()}, mw...)
+	}
+	return Chain(spec.Fn, mw...)
+}
+
+// role returns the default role needed to run the command
+func (spec CommandSpec) role() Role {
+	if spec.Role == RoleUser && spec.Master {
+		return RoleAdmin
+	}
+	return spec.Role
+}
+
+// checkArgs replies with usage if there are too few or too many arguments
+func (spec CommandSpec) checkArgs() Middleware {
+	max := spec.MaxArgs
+	if max == 0 {
+		max = -1
+	}
+	if spec.Usage == "" {
+		return Args(spec.MinArgs, max)
+	}
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			n := len(irc.Arguments)
+			if n >= spec.MinArgs && (max < 0 || n <= max) {
+				next(c, irc)
+				return
+			}
+			irc.Reply(c, "usage: "+c.commandPrefix(irc, spec.Master)+spec.Name+" "+spec.Usage)
+		}
+	}
+}
+
+// Help returns the command's documentation, one or more lines
+func (spec CommandSpec) Help(prefix string) string {
+	var b bytes.Buffer
+	b.WriteString(strings.TrimSpace(prefix + spec.Name + " " + spec.Usage))
+	if spec.Summary != "" {
+		b.WriteString(": " + spec.Summary)
+	}
+	if role := spec.role(); role != RoleUser {
+		b.WriteString(" (" + role.String() + ")")
+	}
+	if len(spec.Aliases) != 0 {
+		b.WriteString("\naliases: " + prefix + strings.Join(spec.Aliases, " "+prefix))
+	}
+	for _, example := range spec.Examples {
+		b.WriteString("\nexample: " + prefix + spec.Name + " " + example)
+	}
+	return b.String()
+}
+
+// Registry holds documented commands, by name and alias
+type Registry struct {
+	lock   sync.Mutex
+	public map[string]*CommandSpec
+	master map[string]*CommandSpec
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		public: make(map[string]*CommandSpec),
+		master: make(map[string]*CommandSpec),
+	}
+}
+
+// DefaultRegistry returns a registry with the default commands, see DefaultCommands
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	for _, spec := range DefaultCommands() {
+		if err := r.Register(spec); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// Register adds a command, replacing one with the same name.
+// It is an error if an alias is already the name of another command.
+func (r *Registry) Register(spec CommandSpec) error {
+	_, err := r.register(spec)
+	return err
+}
+
+// register is Register, returning the aliases of the replaced command that spec does not have
+func (r *Registry) register(spec CommandSpec) (stale []string, err error) {
+	if spec.Name == "" || spec.Fn == nil {
+		return nil, fmt.Errorf("command needs a name and a func")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m := r.specs(spec.Master)
+	if other, ok := m[spec.Name]; ok && other.Name != spec.Name {
+		return nil, fmt.Errorf("command %q is an alias of %q", spec.Name, other.Name)
+	}
+	for _, alias := range spec.Aliases {
+		if other, ok := m[alias]; ok && other.Name != spec.Name {
+			return nil, fmt.Errorf("command %q: alias %q is taken by %q", spec.Name, alias, other.Name)
+		}
+	}
+	if old, ok := m[spec.Name]; ok {
+		for _, alias := range old.Aliases {
+			delete(m, alias)
+			if !contains(spec.Aliases, alias) {
+				stale = append(stale, alias)
+			}
+		}
+	}
+	m[spec.Name] = &spec
+	for _, alias := range spec.Aliases {
+		m[alias] = &spec
+	}
+	return stale, nil
+}
+
+// remove the command with name (or alias), returning its name and aliases, or nil if it is not registered
+func (r *Registry) remove(name string, master bool) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m := r.specs(master)
+	spec, ok := m[name]
+	if !ok {
+		return nil
+	}
+	names := append([]string{spec.Name}, spec.Aliases...)
+	for _, name := range names {
+		delete(m, name)
+	}
+	return names
+}
+
+// specs returns the public or master map, locked by caller
+func (r *Registry) specs(master bool) map[string]*CommandSpec {
+	if master {
+		return r.master
+	}
+	return r.public
+}
+
+// Lookup returns a public or master command, by name or alias
+func (r *Registry) Lookup(name string, master bool) (CommandSpec, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	spec, ok := r.specs(master)[name]
+	if !ok {
+		return CommandSpec{}, false
+	}
+	return *spec, true
+}
+
+// Commands returns the public or master commands, sorted by category and name
+func (r *Registry) Commands(master bool) []CommandSpec {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var list []CommandSpec
+	for name, spec := range r.specs(master) {
+		if name == spec.Name {
+			list = append(list, *spec)
+		}
+	}
+	sort.Sort(byCategory(list))
+	return list
+}
+
+type byCategory []CommandSpec
+
+func (s byCategory) Len() int      { return len(s) }
+func (s byCategory) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCategory) Less(i, j int) bool {
+	if s[i].Category != s[j].Category {
+		return s[i].Category < s[j].Category
+	}
+	return s[i].Name < s[j].Name
+}
+
+// Markdown returns a command reference, for the docs
+func (r *Registry) Markdown(prefix, masterprefix string) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Commands\n\n")
+	b.WriteString("Public commands start with `" + prefix + "`, master commands start with `" + masterprefix + "`.\n\n")
+	writeMarkdown(&b, "## Public commands", prefix, r.Commands(false))
+	writeMarkdown(&b, "## Master commands", masterprefix, r.Commands(true))
+	return append(bytes.TrimSpace(b.Bytes()), '\n')
+}
+
+func writeMarkdown(b *bytes.Buffer, title, prefix string, specs []CommandSpec) {
+	fmt.Fprintf(b, "%s\n\n", title)
+	category := "\x00"
+	for _, spec := range specs {
+		if spec.Hidden {
+			continue
+		}
+		if spec.Category != category {
+			category = spec.Category
+			name := category
+			if name == "" {
+				name = "other"
+			}
+			fmt.Fprintf(b, "### %s\n\n", name)
+		}
+		fmt.Fprintf(b, "#### `%s`\n\n", strings.TrimSpace(prefix+spec.Name+" "+spec.Usage))
+		if spec.Summary != "" {
+			fmt.Fprintf(b, "%s\n\n", spec.Summary)
+		}
+		if role := spec.role(); role != RoleUser {
+			fmt.Fprintf(b, "Needs role: %s\n\n", role)
+		}
+		if len(spec.Aliases) != 0 {
+			fmt.Fprintf(b, "Aliases: `%s`\n\n", prefix+strings.Join(spec.Aliases, "`, `"+prefix))
+		}
+		if len(spec.Examples) != 0 {
+			b.WriteString("Examples:\n\n")
+			for _, example := range spec.Examples {
+				fmt.Fprintf(b, "    %s%s %s\n", prefix, spec.Name, example)
+			}
+			b.WriteString("\n")
+		}
+	}
+}
+
+// Register adds a documented command, to the CommandMap or MasterMap, and the help
+func (c *Connection) Register(spec CommandSpec) error {
+	stale, err := c.registry.register(spec)
+	if err != nil {
+		return err
+	}
+	m, fn := c.CommandMap, spec.Command()
+	if spec.Master {
+		m = c.MasterMap
+	}
+	c.maplock.Lock()
+	defer c.maplock.Unlock()
+	for _, alias := range stale {
+		delete(m, alias)
+	}
+	for _, name := range append([]string{spec.Name}, spec.Aliases...) {
+		m[name] = fn
+	}
+	return nil
+}
+
+// Registry returns the connection's documented commands.
+// When running in a Bot, see Bot.Registry for the shared ones.
+func (c *Connection) Registry() *Registry {
+	return c.registry
+}
+
+// spec returns the named command's documentation, a network's own before the Bot's
+func (c *Connection) spec(name string, master bool) (CommandSpec, bool) {
+	if spec, ok := c.registry.Lookup(name, master); ok || c.bot == nil {
+		return spec, ok
+	}
+	return c.bot.registry.Lookup(name, master)
+}
+
+// commandPrefix returns the public command prefix where irc was sent (see Settings), or the master prefix
+func (c *Connection) commandPrefix(irc *IRC, master bool) string {
+	if !master {
+		return c.Settings(irc.To).CommandPrefix
+	}
+	if i := strings.Index(c.config.Master, ":"); i != -1 {
+		return c.config.Master[i+1:]
+	}
+	return ""
+}
+
+// help replies with the list of commands, or help for the command named in the first argument
+func (c *Connection) help(irc *IRC, master bool) {
+	prefix := c.commandPrefix(irc, master)
+	if len(irc.Arguments) == 0 || irc.Arguments[0] == "" {
+		var list []string
+		for _, name := range c.commandNames(master) {
+			// no aliases or hidden
+			if spec, ok := c.spec(name, master); ok && (spec.Hidden || spec.Name != name) {
+				continue
+			}
+			list = append(list, name)
+		}
+		what := "commands"
+		if master {
+			what = "master commands"
+		}
+		irc.Reply(c, fmt.Sprintf("%v %s: %s (%shelp <command> for more)", len(list), what, list, prefix))
+		return
+	}
+	name := strings.TrimPrefix(irc.Arguments[0], prefix)
+	spec, ok := c.spec(name, master)
+	if !ok {
+		if _, ok := c.command(name); ok && !master {
+			irc.Reply(c, fmt.Sprintf("no help for %q", name))
+			return
+		}
+		if _, ok := c.masterCommand(name); ok && master {
+			irc.Reply(c, fmt.Sprintf("no help for %q", name))
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("no command %q", name))
+		return
+	}
+	for _, line := range strings.Split(spec.Help(prefix), "\n") {
+		irc.Reply(c, line)
+	}
+}
+
+// Register adds a documented command for all networks
+func (b *Bot) Register(spec CommandSpec) error {
+	stale, err := b.registry.register(spec)
+	if err != nil {
+		return err
+	}
+	m, fn := b.CommandMap, spec.Command()
+	if spec.Master {
+		m = b.MasterMap
+	}
+	b.maplock.Lock()
+	defer b.maplock.Unlock()
+	for _, alias := range stale {
+		delete(m, alias)
+	}
+	for _, name := range append([]string{spec.Name}, spec.Aliases...) {
+		m[name] = fn
+	}
+	return nil
+}
+
+// Registry returns the documented commands shared by all networks
+func (b *Bot) Registry() *Registry {
+	return b.registry
+}
@@ -0,0 +1,96 @@
+package ircb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := DefaultRegistry()
+	spec, ok := r.Lookup("uptime", false)
+	if !ok || spec.Name != "up" {
+		t.Fatalf("alias lookup: %v %v", spec.Name, ok)
+	}
+	if _, ok := r.Lookup("uptime", true); ok {
+		t.Errorf("public command found as master command")
+	}
+	help := r.public["define"].Help("!")
+	for _, expected := range []string{"!define <word> <text> | lock|unlock <word>: define", "example: !define ircb"} {
+		if !strings.Contains(help, expected) {
+			t.Errorf("help: expected %q in %q", expected, help)
+		}
+	}
+
+	fn := func(c *Connection, irc *IRC) {}
+	if err := r.Register(CommandSpec{Name: "roll", Aliases: []string{"help"}, Fn: fn}); err == nil {
+		t.Errorf("expected error for taken alias")
+	}
+	if err := r.Register(CommandSpec{Name: "uptime", Fn: fn}); err == nil {
+		t.Errorf("expected error for name taken by alias")
+	}
+	if err := r.Register(CommandSpec{Name: "roll", Aliases: []string{"dice"}, Fn: fn}); err != nil {
+		t.Error(err)
+	}
+
+	md := r.Markdown("!", "@")
+	for _, expected := range []string{"#### `!karma [nick] | top|bottom [n] | rank|why|global [nick]`", "#### `@set <links|define|karma> <on|off>`", "Aliases: `!uptime`"} {
+		if !bytes.Contains(md, []byte(expected)) {
+			t.Errorf("markdown: expected %q", expected)
+		}
+	}
+	if bytes.Contains(md, []byte("@quit")) {
+		t.Errorf("markdown: hidden command listed")
+	}
+}
+
+func TestHelp(t *testing.T) {
+	c := NewTestConnection()
+	c.CommandMap = DefaultCommandMap()
+	c.MasterMap = DefaultMasterMap()
+	tc := c.conn.(*testconnection)
+	irc := c.config.Parse(":nick!user@host PRIVMSG #channel :!help karma")
+	commandHelp(c, irc)
+	if out := tc.buf.String(); !strings.Contains(out, "global [nick]: show karma") {
+		t.Errorf("help karma: %q", out)
+	}
+	tc.buf.Reset()
+	irc = c.config.Parse(":nick!user@host PRIVMSG #channel :!help")
+	commandHelp(c, irc)
+	if out := tc.buf.String(); !strings.Contains(out, "commands: [about define factoid help karma quiet undefine up]") {
+		t.Errorf("help: %q", out)
+	}
+}
+
+func TestRegisterAliases(t *testing.T) {
+	c := NewTestConnection()
+	c.CommandMap = DefaultCommandMap()
+	fn := func(c *Connection, irc *IRC) {}
+	if err := c.Register(CommandSpec{Name: "roll", Aliases: []string{"dice", "d"}, Fn: fn}); err != nil {
+		t.Fatal(err)
+	}
+	// replaced, without 'd'
+	if err := c.Register(CommandSpec{Name: "roll", Aliases: []string{"dice"}, Fn: fn}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.CommandMap["d"]; ok {
+		t.Errorf("old alias still in the command map")
+	}
+	if _, ok := c.registry.Lookup("d", false); ok {
+		t.Errorf("old alias still registered")
+	}
+	if _, ok := c.CommandMap["dice"]; !ok {
+		t.Errorf("alias missing")
+	}
+
+	// removed by alias
+	c.RemoveCommand("dice")
+	for _, name := range []string{"roll", "dice"} {
+		if _, ok := c.CommandMap[name]; ok {
+			t.Errorf("%s: still in the command map", name)
+		}
+		if _, ok := c.registry.Lookup(name, false); ok {
+			t.Errorf("%s: still registered", name)
+		}
+	}
+}
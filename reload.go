@@ -0,0 +1,205 @@
+package ircb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// fields that only change when reconnecting, or restarting
+var (
+	reconnectFields = []string{"Host", "UseSSL", "InvalidSSL", "SASL", "SASLUser", "SASLPass", "TLSCert", "TLSKey", "Capabilities"}
+	restartFields   = []string{"Network", "Database", "Diamond", "DiamondSocket"}
+)
+
+// configFile returns the config file to reload from, see Connection.ConfigFile
+func configFile(name string) string {
+	if name == "" {
+		return "config.json"
+	}
+	return name
+}
+
+// Reload reads ConfigFile again and applies it, see Connection.ApplyConfig.
+// Options not in the file are left as they are.
+// It runs on the connection's goroutine (see Do), so it is safe from a signal handler.
+func (c *Connection) Reload() (changes []string, err error) {
+	if c.bot != nil {
+		return c.bot.Reload()
+	}
+	c.Do(func() { changes, err = c.reload() })
+	return changes, err
+}
+
+// reload is Reload, on the connection's goroutine (from a command)
+func (c *Connection) reload() ([]string, error) {
+	if c.bot != nil {
+		return c.bot.reload(c)
+	}
+	b, err := ReadConfigFile(configFile(c.ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	var networks struct {
+		Networks []json.RawMessage
+	}
+	if json.Unmarshal(b, &networks) == nil && len(networks.Networks) != 0 {
+		return nil, fmt.Errorf("config now lists networks, restart to run them")
+	}
+	config := *c.config
+	config.Nick = c.nick
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return c.ApplyConfig(&config), nil
+}
+
+// ApplyConfig replaces the running config, returning what changed.
+// Channels are joined and parted, a new Nick is taken, and features are toggled right away.
+// Some options only change when reconnecting (such as Host), and a few need a restart (such as Database).
+// Call it on the connection's goroutine, see Do.
+func (c *Connection) ApplyConfig(config *Config) []string {
+	old := *c.config
+	old.Nick = c.nick
+	next := *config
+	var changes []string
+	for _, k := range restartFields {
+		if field(old, k) != field(next, k) {
+			changes = append(changes, k+" needs a restart")
+		}
+	}
+	next.Network, next.Database, next.Diamond, next.DiamondSocket = old.Network, old.Database, old.Diamond, old.DiamondSocket
+	for _, change := range configChanges(old, next) {
+		for _, k := range reconnectFields {
+			if strings.HasPrefix(change, k+":") || change == k+" changed" {
+				change += " (on reconnect)"
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	// keep using an alternate nick until the new one is taken
+	primary := next.Nick
+	next.Nick = c.config.Nick
+	*c.config = next
+	c.queue.configure(c.config)
+	if primary != old.Nick {
+		c.nick = primary
+		c.nicktries = 0
+		if c.joined {
+			c.Write([]byte("NICK " + primary))
+		}
+	}
+
+	if c.joined && old.Channels != next.Channels {
+		oldlist, newlist := channelList(c, old.Channels), channelList(c, next.Channels)
+		for name, ch := range newlist {
+			if _, ok := oldlist[name]; !ok {
+				c.Log.Println("Joining channel:", ch)
+				c.Write([]byte("JOIN " + ch))
+			}
+		}
+		for name, ch := range oldlist {
+			if _, ok := newlist[name]; !ok {
+				c.Log.Println("Parting channel:", ch)
+				c.Write([]byte("PART " + ch))
+			}
+		}
+	}
+	for _, change := range changes {
+		c.Log.Println("config:", change)
+	}
+	return changes
+}
+
+// channelList returns comma separated channels, by folded name
+func channelList(c *Connection, channels string) map[string]string {
+	m := make(map[string]string)
+	for _, ch := range strings.Split(channels, ",") {
+		if ch = strings.TrimSpace(ch); ch != "" {
+			m[c.Fold(ch)] = ch
+		}
+	}
+	return m
+}
+
+// field returns a config field as JSON, by name
+func field(config Config, name string) string {
+	var m map[string]json.RawMessage
+	b, _ := json.Marshal(config)
+	json.Unmarshal(b, &m)
+	return string(m[name])
+}
+
+// Reload reads ConfigFile again and applies it to each network, see Connection.ApplyConfig.
+// Networks added or removed need a restart.
+func (b *Bot) Reload() ([]string, error) {
+	return b.reload(nil)
+}
+
+// reload applies the config file on each network's goroutine, see Connection.Do.
+// From a command (on self's goroutine), the other networks are not waited for, and log their own changes.
+func (b *Bot) reload(self *Connection) ([]string, error) {
+	bc, err := LoadBotConfig(configFile(b.ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	b.configlock.Lock()
+	database := b.config.Database
+	b.configlock.Unlock()
+	var changes []string
+	seen := make(map[string]bool)
+	for _, config := range bc.Networks {
+		config := config
+		seen[config.Network] = true
+		c := b.networks[config.Network]
+		if c == nil {
+			changes = append(changes, fmt.Sprintf("network %q added, needs a restart", config.Network))
+			continue
+		}
+		config.Diamond = false
+		config.Database = database
+		var list []string
+		switch {
+		case c == self:
+			list = c.ApplyConfig(config)
+		case self == nil:
+			c.Do(func() { list = c.ApplyConfig(config) })
+		default:
+			go c.Do(func() { c.ApplyConfig(config) })
+			list = []string{"applying, see its log"}
+		}
+		for _, change := range list {
+			changes = append(changes, fmt.Sprintf("[%s] %s", config.Network, change))
+		}
+	}
+	for _, name := range b.Networks() {
+		if !seen[name] {
+			changes = append(changes, fmt.Sprintf("network %q removed, needs a restart", name))
+		}
+	}
+	b.configlock.Lock()
+	global := bc.Config
+	global.Database, global.Diamond, global.DiamondSocket = b.config.Database, b.config.Diamond, b.config.DiamondSocket
+	b.config.Config = global
+	b.configlock.Unlock()
+	return changes, nil
+}
+
+// commandMasterReload reloads the config file, see Connection.Reload
+func commandMasterReload(c *Connection, irc *IRC) {
+	changes, err := c.reload()
+	if err != nil {
+		c.Log.Println("reload error:", err)
+		irc.Reply(c, "reload failed: "+err.Error())
+		return
+	}
+	if len(changes) == 0 {
+		irc.Reply(c, "reloaded, nothing changed")
+		return
+	}
+	irc.Reply(c, "reloaded: "+strings.Join(changes, ", "))
+}
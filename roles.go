@@ -0,0 +1,487 @@
+package ircb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Role is what someone is allowed to do, each role can do everything the ones below it can
+type Role int
+
+const (
+	RoleUser     Role = iota // anyone
+	RoleTrusted              // trusted, or voice in the channel
+	RoleOperator             // operator, or op in the channel
+	RoleAdmin                // can use master commands
+	RoleOwner                // can do anything, the authenticated master (see Config.Master) is always owner
+)
+
+var roleNames = []string{"user", "trusted", "operator", "admin", "owner"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole returns the role named s, such as 'admin'
+func ParseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return Role(i), nil
+		}
+	}
+	return RoleUser, fmt.Errorf("no role %q, use one of %s", s, strings.Join(roleNames, ", "))
+}
+
+// Identity is who sent a message, as far as we know
+type Identity struct {
+	Nick    string
+	User    string
+	Host    string
+	Account string // services account, can be empty
+	CertFP  string // TLS client certificate fingerprint, from WHOIS, can be empty
+}
+
+// Grant gives a role to everyone matching Mask, in one channel or all of them.
+//
+// Mask can be a services account 'account:name', a TLS certificate fingerprint 'certfp:hex',
+// or a hostmask glob such as 'nick!*@example.com' or '*!*@*.example.com'.
+// A hostmask needs a host: anyone can use a nick, so 'bob' or 'bob!*@*' is not allowed.
+type Grant struct {
+	Mask    string
+	Role    Role
+	Channel string // can be empty for all channels and private messages
+	By      string // who granted it
+	Time    time.Time
+}
+
+// Matches returns true if the grant's mask matches id.
+// Accounts and hostmasks are compared with fold, certificate fingerprints ignore case and colons.
+func (g Grant) Matches(id Identity, fold func(string) string) bool {
+	switch {
+	case strings.HasPrefix(g.Mask, "account:"):
+		return id.Account != "" && fold(id.Account) == fold(strings.TrimPrefix(g.Mask, "account:"))
+	case strings.HasPrefix(g.Mask, "certfp:"):
+		return id.CertFP != "" && normalizeFP(id.CertFP) == normalizeFP(strings.TrimPrefix(g.Mask, "certfp:"))
+	case !validMask(g.Mask):
+		// just a nick, from before they were refused
+		return false
+	}
+	return globMatch(fold(g.Mask), fold(id.Nick+"!"+id.User+"@"+id.Host))
+}
+
+// ErrGrantMask when a grant's mask is only a nick, see Grant
+var ErrGrantMask = fmt.Errorf("mask needs account:, certfp: or a host, such as nick!*@example.com")
+
+// validMask returns true if mask is an account, a certificate fingerprint, or a hostmask with a host
+func validMask(mask string) bool {
+	if strings.HasPrefix(mask, "account:") || strings.HasPrefix(mask, "certfp:") {
+		return true
+	}
+	i := strings.LastIndexByte(mask, '@')
+	return i != -1 && strings.Trim(mask[i+1:], "*?.") != ""
+}
+
+func normalizeFP(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
+
+// globMatch matches s against a pattern with '*' (anything) and '?' (any one character)
+func globMatch(pattern, s string) bool {
+	var p, i, star, mark = 0, 0, -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star != -1:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// certfps are TLS client certificate fingerprints from WHOIS replies (276)
+type certfps struct {
+	lock   sync.Mutex
+	byNick map[string]string // by folded nick
+}
+
+func newCertFPs() *certfps {
+	return &certfps{byNick: make(map[string]string)}
+}
+
+// learnCertFP from ':server 276 bot nick :has client certificate fingerprint HEX',
+// and forgets it when the nick changes or quits.
+func (c *Connection) learnCertFP(irc *IRC) {
+	c.certfps.lock.Lock()
+	defer c.certfps.lock.Unlock()
+	switch irc.Verb {
+	case "276": // RPL_WHOISCERTFP
+		if len(irc.Params) < 3 {
+			return
+		}
+		fields := strings.Fields(irc.Message)
+		if len(fields) == 0 {
+			return
+		}
+		c.certfps.byNick[c.Fold(irc.Params[1])] = fields[len(fields)-1]
+	case "NICK", "QUIT":
+		delete(c.certfps.byNick, c.Fold(irc.Nick))
+	}
+}
+
+// Identify returns the identity of whoever sent irc.
+// The account is from the account-tag, what we learned about the nick (see Connection.Account), or a channel we share.
+func (c *Connection) Identify(irc *IRC) Identity {
+	id := Identity{Nick: irc.Nick, User: irc.User, Host: irc.Host}
+	if account := irc.Tags["account"]; account != "" && account != "*" {
+		id.Account = account
+	}
+	if id.Account == "" {
+		id.Account, _ = c.Account(irc.Nick)
+	}
+	if id.Account == "" {
+		c.chans.mu.RLock()
+		for _, ch := range c.chans.channels {
+			if m, ok := ch.Members[c.chans.fold(irc.Nick)]; ok && m.Account != "" {
+				id.Account = m.Account
+				break
+			}
+		}
+		c.chans.mu.RUnlock()
+	}
+	c.certfps.lock.Lock()
+	id.CertFP = c.certfps.byNick[c.Fold(irc.Nick)]
+	c.certfps.lock.Unlock()
+	return id
+}
+
+// Role returns the role of whoever sent irc, in the channel it was sent to.
+// It is the highest of: their grants, their channel privileges (op is operator, voice is trusted),
+// and owner for the authenticated master.
+func (c *Connection) Role(irc *IRC) Role {
+	if c.isMaster(irc) {
+		return RoleOwner
+	}
+	role := RoleUser
+	channel := ""
+	if c.IsChannel(irc.To) {
+		channel = irc.To
+		switch {
+		case c.IsOp(channel, irc.Nick):
+			role = RoleOperator
+		case c.IsVoice(channel, irc.Nick):
+			role = RoleTrusted
+		}
+	}
+	id := c.Identify(irc)
+	for _, g := range c.Grants("") {
+		if g.Role > role && (g.Channel == "" || c.EqualFold(g.Channel, channel)) && g.Matches(id, c.Fold) {
+			role = g.Role
+		}
+	}
+	return role
+}
+
+// RequireRole runs the command only if the sender has at least role, see Connection.Role
+func RequireRole(role Role) Middleware {
+	return func(next Command) Command {
+		return func(c *Connection, irc *IRC) {
+			c.authorize(irc, role, func() { next(c, irc) })
+		}
+	}
+}
+
+// commandRole returns the role needed to run a command:
+// set with the 'role command' master command, or CommandSpec.Role, or the default (user, or admin for master commands)
+func (c *Connection) commandRole(name string, master bool) Role {
+	if role, ok := c.commandRoleOverride(name, master); ok {
+		return role
+	}
+	if spec, ok := c.spec(name, master); ok {
+		return spec.role()
+	}
+	if master {
+		return RoleAdmin
+	}
+	return RoleUser
+}
+
+var dbroles = []byte("roles")
+var dbcommandroles = []byte("commandroles")
+
+// grantKey is the database key for a grant, channel can be empty
+func (c *Connection) grantKey(mask, channel string) []byte {
+	return []byte(c.Fold(channel) + " " + mask)
+}
+
+// Grants returns the role grants for one channel, or all if channel is empty
+func (c *Connection) Grants(channel string) []Grant {
+	var grants []Grant
+	if c.boltdb == nil {
+		return nil
+	}
+	err := c.boltdb.View(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbroles)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var g Grant
+			if err := json.Unmarshal(v, &g); err != nil {
+				return err
+			}
+			if channel == "" || c.EqualFold(g.Channel, channel) {
+				grants = append(grants, g)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		c.Log.Println("roles error:", err)
+	}
+	sort.Sort(byRole(grants))
+	return grants
+}
+
+type byRole []Grant
+
+func (g byRole) Len() int      { return len(g) }
+func (g byRole) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g byRole) Less(i, j int) bool {
+	if g[i].Role != g[j].Role {
+		return g[i].Role > g[j].Role
+	}
+	if g[i].Channel != g[j].Channel {
+		return g[i].Channel < g[j].Channel
+	}
+	return g[i].Mask < g[j].Mask
+}
+
+// AddGrant saves a grant, replacing one with the same mask and channel.
+// It returns ErrGrantMask for a mask that is only a nick.
+func (c *Connection) AddGrant(g Grant) error {
+	if !validMask(g.Mask) {
+		return ErrGrantMask
+	}
+	if g.Time.IsZero() {
+		g.Time = time.Now()
+	}
+	b, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return c.boltdb.Update(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbroles)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		return bucket.Put(c.grantKey(g.Mask, g.Channel), b)
+	})
+}
+
+// RemoveGrant removes the grant for mask in channel (can be empty), returning false if there was none
+func (c *Connection) RemoveGrant(mask, channel string) (bool, error) {
+	var found bool
+	err := c.boltdb.Update(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbroles)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		key := c.grantKey(mask, channel)
+		found = bucket.Get(key) != nil
+		return bucket.Delete(key)
+	})
+	return found, err
+}
+
+// commandRoleKey is the database key for a command's role
+func commandRoleKey(name string, master bool) []byte {
+	if master {
+		return []byte("master " + name)
+	}
+	return []byte("public " + name)
+}
+
+func (c *Connection) commandRoleOverride(name string, master bool) (Role, bool) {
+	var role Role
+	var ok bool
+	if c.boltdb == nil {
+		return role, false
+	}
+	c.boltdb.View(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbcommandroles)
+		if bucket == nil {
+			return nil
+		}
+		if v := bucket.Get(commandRoleKey(name, master)); v != nil {
+			role, ok = Role(bytes2int(v)), true
+		}
+		return nil
+	})
+	return role, ok
+}
+
+// SetCommandRole changes the role needed to run a command
+func (c *Connection) SetCommandRole(name string, master bool, role Role) error {
+	return c.boltdb.Update(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbcommandroles)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		return bucket.Put(commandRoleKey(name, master), int2bytes(int(role)))
+	})
+}
+
+// ResetCommandRole goes back to the command's default role
+func (c *Connection) ResetCommandRole(name string, master bool) error {
+	return c.boltdb.Update(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbcommandroles)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		return bucket.Delete(commandRoleKey(name, master))
+	})
+}
+
+// commandMasterRole manages roles:
+//
+//	role grant <role> <mask> [channel]
+//	role revoke <mask> [channel]
+//	role list [channel]
+//	role command <name> <role|default>
+func commandMasterRole(c *Connection, irc *IRC) {
+	args := irc.Arguments
+	sub := args[0]
+	args = args[1:]
+	channel := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	switch sub {
+	default:
+		irc.Reply(c, "usage: role grant|revoke|list|command")
+	case "grant":
+		if len(args) < 2 || len(args) > 3 {
+			irc.Reply(c, "usage: role grant <role> <mask> [channel]")
+			return
+		}
+		role, err := ParseRole(args[0])
+		if err != nil {
+			irc.Reply(c, err.Error())
+			return
+		}
+		// only owners can make others as powerful as themselves
+		if mine := c.Role(irc); role >= mine && mine != RoleOwner {
+			irc.Reply(c, fmt.Sprintf("%s can not grant %s", mine, role))
+			return
+		}
+		g := Grant{Mask: args[1], Role: role, Channel: channel(2), By: irc.Prefix}
+		if err := c.AddGrant(g); err == ErrGrantMask {
+			irc.Reply(c, err.Error())
+			return
+		} else if err != nil {
+			c.Log.Println("roles error:", err)
+			irc.Reply(c, "error saving grant, check logs")
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("granted %s to %s%s", role, g.Mask, inChannel(g.Channel)))
+	case "revoke":
+		if len(args) < 1 || len(args) > 2 {
+			irc.Reply(c, "usage: role revoke <mask> [channel]")
+			return
+		}
+		for _, g := range c.Grants(channel(1)) {
+			if g.Mask == args[0] && c.EqualFold(g.Channel, channel(1)) {
+				if mine := c.Role(irc); g.Role >= mine && mine != RoleOwner {
+					irc.Reply(c, fmt.Sprintf("%s can not revoke %s", mine, g.Role))
+					return
+				}
+			}
+		}
+		found, err := c.RemoveGrant(args[0], channel(1))
+		if err != nil {
+			c.Log.Println("roles error:", err)
+			irc.Reply(c, "error removing grant, check logs")
+			return
+		}
+		if !found {
+			irc.Reply(c, fmt.Sprintf("no grant for %s%s", args[0], inChannel(channel(1))))
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("revoked %s%s", args[0], inChannel(channel(1))))
+	case "list":
+		grants := c.Grants(channel(0))
+		if len(grants) == 0 {
+			irc.Reply(c, "no grants")
+			return
+		}
+		for _, g := range grants {
+			irc.Reply(c, fmt.Sprintf("%s: %s%s", g.Role, g.Mask, inChannel(g.Channel)))
+		}
+	case "command":
+		if len(args) != 2 {
+			irc.Reply(c, "usage: role command <name> <role|default> (prefix the name with "+c.commandPrefix(irc, true)+" for master commands)")
+			return
+		}
+		name, master := args[0], false
+		if prefix := c.commandPrefix(irc, true); prefix != "" && strings.HasPrefix(name, prefix) {
+			name, master = strings.TrimPrefix(name, prefix), true
+		}
+		if args[1] == "default" {
+			// like setting it, so an admin can not undo an owner's lockdown
+			if mine := c.Role(irc); c.commandRole(name, master) > mine {
+				irc.Reply(c, fmt.Sprintf("%s can not change %s", mine, name))
+				return
+			}
+			if err := c.ResetCommandRole(name, master); err != nil {
+				c.Log.Println("roles error:", err)
+			}
+			irc.Reply(c, fmt.Sprintf("%s needs %s", name, c.commandRole(name, master)))
+			return
+		}
+		role, err := ParseRole(args[1])
+		if err != nil {
+			irc.Reply(c, err.Error())
+			return
+		}
+		if mine := c.Role(irc); role > mine || c.commandRole(name, master) > mine {
+			irc.Reply(c, fmt.Sprintf("%s can not change %s", mine, name))
+			return
+		}
+		if err := c.SetCommandRole(name, master, role); err != nil {
+			c.Log.Println("roles error:", err)
+			irc.Reply(c, "error saving command role, check logs")
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("%s needs %s", name, role))
+	}
+}
+
+func inChannel(channel string) string {
+	if channel == "" {
+		return ""
+	}
+	return " in " + channel
+}
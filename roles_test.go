@@ -0,0 +1,104 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"*", "anything", true},
+		{"nick!*@*", "nick!user@host", true},
+		{"nick!*@*", "nick2!user@host", false},
+		{"*!*@*.example.com", "a!b@c.example.com", true},
+		{"*!*@*.example.com", "a!b@example.com", false},
+		{"n?ck!*", "nick!u@h", true},
+		{"[a]!*", "[a]!u@h", true},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+	} {
+		if got := globMatch(tt.pattern, tt.s); got != tt.expected {
+			t.Errorf("globMatch(%q, %q): expected %v, got %v", tt.pattern, tt.s, tt.expected, got)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+
+	for _, g := range []Grant{
+		{Mask: "account:Alice", Role: RoleAdmin},
+		{Mask: "*!*@trusted.example.com", Role: RoleTrusted},
+		{Mask: "bob!*@bob.example.com", Role: RoleOperator, Channel: "#Chan"},
+		{Mask: "certfp:AB:CD:EF", Role: RoleOwner},
+	} {
+		if err := c.AddGrant(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.certfps.byNick["carol"] = "abcdef"
+
+	for _, tt := range []struct {
+		input    string
+		expected Role
+	}{
+		{"@account=alice :someone!u@h PRIVMSG #chan :hi", RoleAdmin},
+		{":someone!u@trusted.example.com PRIVMSG #chan :hi", RoleTrusted},
+		{":Bob!u@bob.example.com PRIVMSG #chan :hi", RoleOperator},
+		{":bob!u@h PRIVMSG #chan :hi", RoleUser},
+		{":bob!u@bob.example.com PRIVMSG #other :hi", RoleUser},
+		{":Carol!u@h PRIVMSG #other :hi", RoleOwner},
+		{":nobody!u@h PRIVMSG #chan :hi", RoleUser},
+	} {
+		if got := c.Role(Parse(tt.input)); got != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.input, tt.expected, got)
+		}
+	}
+
+	if found, err := c.RemoveGrant("bob!*@bob.example.com", "#chan"); !found || err != nil {
+		t.Errorf("remove grant: %v %v", found, err)
+	}
+	if got := c.Role(Parse(":bob!u@bob.example.com PRIVMSG #chan :hi")); got != RoleUser {
+		t.Errorf("removed grant: expected user, got %s", got)
+	}
+
+	// anyone can use a nick
+	for _, mask := range []string{"bob", "bob!*@*", "bob!*", "*!*@*.*"} {
+		if err := c.AddGrant(Grant{Mask: mask, Role: RoleAdmin}); err != ErrGrantMask {
+			t.Errorf("%q: expected ErrGrantMask, got %v", mask, err)
+		}
+	}
+	if (Grant{Mask: "bob!*@*"}).Matches(Identity{Nick: "bob", User: "u", Host: "h"}, strings.ToLower) {
+		t.Errorf("nick only grant matched")
+	}
+
+	if got := c.commandRole("do", true); got != RoleOwner {
+		t.Errorf("do: expected owner, got %s", got)
+	}
+	if got := c.commandRole("set", true); got != RoleAdmin {
+		t.Errorf("set: expected admin, got %s", got)
+	}
+	c.SetCommandRole("define", false, RoleTrusted)
+	if got := c.commandRole("define", false); got != RoleTrusted {
+		t.Errorf("define: expected trusted, got %s", got)
+	}
+
+	// an admin can not undo an owner's lockdown
+	tc := c.conn.(*testconnection)
+	c.SetCommandRole("define", false, RoleOwner)
+	irc := Parse("@account=alice :alice!u@h PRIVMSG #chan :role command define default")
+	irc.Arguments = []string{"command", "define", "default"}
+	commandMasterRole(c, irc)
+	if got := c.commandRole("define", false); got != RoleOwner || !strings.Contains(tc.buf.String(), "admin can not change define") {
+		t.Errorf("define: expected owner, got %s %q", got, tc.buf.String())
+	}
+	c.SetCommandRole("define", false, RoleAdmin)
+	commandMasterRole(c, irc)
+	if got := c.commandRole("define", false); got != RoleUser {
+		t.Errorf("define: expected default, got %s", got)
+	}
+}
@@ -0,0 +1,83 @@
+package ircb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ErrSASLUnavailable when SASL is configured but the server does not offer it
+var ErrSASLUnavailable = fmt.Errorf("sasl not available")
+
+// ErrSASLMechanism when Config.SASL is not a supported mechanism
+var ErrSASLMechanism = fmt.Errorf("sasl mechanism not supported, use PLAIN or EXTERNAL")
+
+// saslStart asks the server to begin authenticating
+func (c *Connection) saslStart() error {
+	mech := strings.ToUpper(c.config.SASL)
+	switch mech {
+	case "PLAIN", "EXTERNAL":
+	default:
+		return ErrSASLMechanism
+	}
+	if mechs, _ := c.CapabilityValue("sasl"); mechs != "" &&
+		!strings.Contains(","+mechs+",", ","+mech+",") {
+		return fmt.Errorf("sasl mechanism %q not in server list %q", mech, mechs)
+	}
+	c.Log.Println("sasl authenticating:", mech)
+	_, err := c.Write([]byte("AUTHENTICATE " + mech))
+	return err
+}
+
+// saslAuthenticate responds to 'AUTHENTICATE +' with credentials
+func (c *Connection) saslAuthenticate(irc *IRC) error {
+	if irc.Message != "+" {
+		return fmt.Errorf("sasl unexpected challenge: %q", irc.Message)
+	}
+	var payload string
+	if strings.ToUpper(c.config.SASL) == "PLAIN" {
+		// authzid \0 authcid \0 password
+		user := c.config.SASLUser
+		if user == "" {
+			user = c.config.Nick
+		}
+		payload = base64.StdEncoding.EncodeToString([]byte(user + "\x00" + user + "\x00" + c.config.SASLPass))
+	}
+
+	// send in 400 byte chunks, '+' for empty or after an exactly 400 byte chunk
+	for {
+		chunk := payload
+		if len(chunk) > 400 {
+			chunk = chunk[:400]
+		}
+		payload = payload[len(chunk):]
+		if chunk == "" {
+			chunk = "+"
+		}
+		if _, err := c.Write([]byte("AUTHENTICATE " + chunk)); err != nil {
+			return err
+		}
+		if len(chunk) < 400 {
+			return nil
+		}
+	}
+}
+
+// saslHandler handles AUTHENTICATE and SASL numerics during registration,
+// returning true when authentication is over and CAP END was sent.
+func (c *Connection) saslHandler(irc *IRC) (bool, error) {
+	switch irc.Verb {
+	case "AUTHENTICATE":
+		return false, c.saslAuthenticate(irc)
+	case "900": // RPL_LOGGEDIN
+		c.Log.Println("sasl:", irc.Message)
+	case "903", "907": // RPL_SASLSUCCESS, ERR_SASLALREADY
+		c.Log.Println("sasl:", irc.Message)
+		return c.capEnd(), nil
+	case "902", "904", "905", "906": // ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED
+		return false, fmt.Errorf("sasl authentication failed (%s): %s", irc.Verb, irc.Message)
+	case "908": // RPL_SASLMECHS
+		c.Log.Println("sasl mechanisms:", irc.Message)
+	}
+	return false, nil
+}
@@ -0,0 +1,444 @@
+package ircb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Settings are what applies in a channel, see Connection.Settings
+type Settings struct {
+	CommandPrefix string
+	Karma         bool
+	Define        bool
+	ParseLinks    bool
+	Muted         bool      // nothing is said in the channel
+	MutedUntil    time.Time // zero if muted until unmuted
+	Language      string    // for plugins, such as 'en'
+	MaxLines      int       // max lines sent for one message, 0 for no limit
+	LocalKarma    bool      // the channel has its own karma scoreboard, see Connection.karmaBoard
+}
+
+// ChannelConfig overrides the network's settings in one channel, nil fields are not overridden
+type ChannelConfig struct {
+	CommandPrefix *string    `json:",omitempty"`
+	Karma         *bool      `json:",omitempty"`
+	Define        *bool      `json:",omitempty"`
+	ParseLinks    *bool      `json:",omitempty"`
+	Muted         *bool      `json:",omitempty"`
+	MutedUntil    *time.Time `json:",omitempty"` // see Connection.Mute
+	Language      *string    `json:",omitempty"`
+	MaxLines      *int       `json:",omitempty"`
+	LocalKarma    *bool      `json:",omitempty"`
+}
+
+// settingNames for the 'channel' master command
+var settingNames = []string{"prefix", "karma", "define", "links", "muted", "language", "maxlines", "localkarma"}
+
+// apply overrides to s
+func (cc ChannelConfig) apply(s Settings) Settings {
+	if cc.CommandPrefix != nil {
+		s.CommandPrefix = *cc.CommandPrefix
+	}
+	if cc.Karma != nil {
+		s.Karma = *cc.Karma
+	}
+	if cc.Define != nil {
+		s.Define = *cc.Define
+	}
+	if cc.ParseLinks != nil {
+		s.ParseLinks = *cc.ParseLinks
+	}
+	if cc.Muted != nil {
+		s.Muted = *cc.Muted
+		if s.Muted && cc.MutedUntil != nil {
+			s.Muted = time.Now().Before(*cc.MutedUntil)
+			s.MutedUntil = *cc.MutedUntil
+		}
+	}
+	if cc.Language != nil {
+		s.Language = *cc.Language
+	}
+	if cc.MaxLines != nil {
+		s.MaxLines = *cc.MaxLines
+	}
+	if cc.LocalKarma != nil {
+		s.LocalKarma = *cc.LocalKarma
+	}
+	return s
+}
+
+// Set a setting by name, such as 'karma' to 'off', or 'default' to stop overriding it
+func (cc *ChannelConfig) Set(name, value string) error {
+	if value == "default" {
+		switch name {
+		case "prefix":
+			cc.CommandPrefix = nil
+		case "karma":
+			cc.Karma = nil
+		case "define":
+			cc.Define = nil
+		case "links":
+			cc.ParseLinks = nil
+		case "muted":
+			cc.Muted, cc.MutedUntil = nil, nil
+		case "language":
+			cc.Language = nil
+		case "maxlines":
+			cc.MaxLines = nil
+		case "localkarma":
+			cc.LocalKarma = nil
+		default:
+			return fmt.Errorf("no setting %q, use one of %s", name, strings.Join(settingNames, ", "))
+		}
+		return nil
+	}
+	onoff := func() (*bool, error) {
+		switch value {
+		case "on", "true", "yes":
+			b := true
+			return &b, nil
+		case "off", "false", "no":
+			b := false
+			return &b, nil
+		}
+		return nil, fmt.Errorf("%s: use on, off or default", name)
+	}
+	var err error
+	switch name {
+	case "prefix":
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("prefix can not be empty")
+		}
+		cc.CommandPrefix = &value
+	case "karma":
+		cc.Karma, err = onoff()
+	case "define":
+		cc.Define, err = onoff()
+	case "links":
+		cc.ParseLinks, err = onoff()
+	case "muted":
+		cc.Muted, err = onoff()
+		cc.MutedUntil = nil
+	case "language":
+		cc.Language = &value
+	case "maxlines":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("maxlines: use a number, 0 for no limit")
+		}
+		cc.MaxLines = &n
+	case "localkarma":
+		cc.LocalKarma, err = onoff()
+	default:
+		return fmt.Errorf("no setting %q, use one of %s", name, strings.Join(settingNames, ", "))
+	}
+	return err
+}
+
+// isSet returns true if the named setting is overridden
+func (cc ChannelConfig) isSet(name string) bool {
+	switch name {
+	case "prefix":
+		return cc.CommandPrefix != nil
+	case "karma":
+		return cc.Karma != nil
+	case "define":
+		return cc.Define != nil
+	case "links":
+		return cc.ParseLinks != nil
+	case "muted":
+		return cc.Muted != nil
+	case "language":
+		return cc.Language != nil
+	case "maxlines":
+		return cc.MaxLines != nil
+	case "localkarma":
+		return cc.LocalKarma != nil
+	}
+	return false
+}
+
+// get returns the named setting as text
+func (s Settings) get(name string) string {
+	onoff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+	switch name {
+	case "prefix":
+		return s.CommandPrefix
+	case "karma":
+		return onoff(s.Karma)
+	case "define":
+		return onoff(s.Define)
+	case "links":
+		return onoff(s.ParseLinks)
+	case "muted":
+		if s.Muted && !s.MutedUntil.IsZero() {
+			return "on until " + s.MutedUntil.UTC().Format("2006-01-02 15:04 MST")
+		}
+		return onoff(s.Muted)
+	case "language":
+		return s.Language
+	case "maxlines":
+		return strconv.Itoa(s.MaxLines)
+	case "localkarma":
+		return onoff(s.LocalKarma)
+	}
+	return ""
+}
+
+// feature returns true if the named feature is enabled, unknown features are enabled
+func (s Settings) feature(name string) bool {
+	switch name {
+	case "karma":
+		return s.Karma
+	case "define":
+		return s.Define
+	case "links":
+		return s.ParseLinks
+	}
+	return true
+}
+
+// channelConfigs caches the database, by folded channel name
+type channelConfigs struct {
+	lock   sync.Mutex
+	byName map[string]ChannelConfig
+	timers map[string]*time.Timer // unmute timers, see Mute
+}
+
+func newChannelConfigs() *channelConfigs {
+	return &channelConfigs{
+		byName: make(map[string]ChannelConfig),
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+var dbchannels = []byte("channels")
+
+// Settings returns what applies in a channel: the channel's overrides (see 'channel' master command),
+// then the network's Config (which in a Bot starts with the global options).
+// For private messages (channel is not a channel), there are no overrides.
+func (c *Connection) Settings(channel string) Settings {
+	s := Settings{
+		CommandPrefix: c.config.CommandPrefix,
+		Karma:         c.config.Karma,
+		Define:        c.config.Define,
+		ParseLinks:    c.config.ParseLinks,
+		Language:      c.config.Language,
+		MaxLines:      c.config.MaxLines,
+	}
+	if !c.IsChannel(channel) {
+		return s
+	}
+	return c.ChannelConfig(channel).apply(s)
+}
+
+// ChannelConfig returns a channel's overrides
+func (c *Connection) ChannelConfig(channel string) ChannelConfig {
+	name := c.Fold(channel)
+	c.chanconfigs.lock.Lock()
+	defer c.chanconfigs.lock.Unlock()
+	if cc, ok := c.chanconfigs.byName[name]; ok {
+		return cc
+	}
+	var cc ChannelConfig
+	if c.boltdb == nil {
+		return cc
+	}
+	err := c.boltdb.View(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbchannels)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		if v := bucket.Get([]byte(name)); v != nil {
+			return json.Unmarshal(v, &cc)
+		}
+		return nil
+	})
+	if err != nil {
+		c.Log.Println("channel config error:", err)
+		return cc
+	}
+	c.chanconfigs.byName[name] = cc
+	return cc
+}
+
+// SetChannelConfig saves a channel's overrides
+func (c *Connection) SetChannelConfig(channel string, cc ChannelConfig) error {
+	name := c.Fold(channel)
+	b, err := json.Marshal(cc)
+	if err != nil {
+		return err
+	}
+	c.chanconfigs.lock.Lock()
+	defer c.chanconfigs.lock.Unlock()
+	err = c.boltdb.Update(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbchannels)
+		if bucket == nil {
+			return fmt.Errorf("nil bucket")
+		}
+		if string(b) == "{}" {
+			return bucket.Delete([]byte(name))
+		}
+		return bucket.Put([]byte(name), b)
+	})
+	if err != nil {
+		return err
+	}
+	c.chanconfigs.byName[name] = cc
+	return nil
+}
+
+// Mute a channel for d, or until unmuted if d is 0. Nothing is sent to a muted channel.
+func (c *Connection) Mute(channel string, d time.Duration) error {
+	cc := c.ChannelConfig(channel)
+	muted := true
+	cc.Muted, cc.MutedUntil = &muted, nil
+	if d > 0 {
+		until := time.Now().Add(d)
+		cc.MutedUntil = &until
+	}
+	if err := c.SetChannelConfig(channel, cc); err != nil {
+		return err
+	}
+	c.unmuteAt(channel, cc.MutedUntil)
+	return nil
+}
+
+// Unmute a channel, removing its override
+func (c *Connection) Unmute(channel string) error {
+	cc := c.ChannelConfig(channel)
+	cc.Muted, cc.MutedUntil = nil, nil
+	c.unmuteAt(channel, nil)
+	return c.SetChannelConfig(channel, cc)
+}
+
+// unmuteAt starts the unmute timer for channel, replacing any, or just stops it if until is nil
+func (c *Connection) unmuteAt(channel string, until *time.Time) {
+	name := c.Fold(channel)
+	c.chanconfigs.lock.Lock()
+	defer c.chanconfigs.lock.Unlock()
+	if t, ok := c.chanconfigs.timers[name]; ok {
+		t.Stop()
+		delete(c.chanconfigs.timers, name)
+	}
+	if until == nil {
+		return
+	}
+	at := *until
+	c.chanconfigs.timers[name] = time.AfterFunc(at.Sub(time.Now()), func() {
+		// Send reads the config, which handlers change
+		c.Do(func() {
+			c.closelock.Lock()
+			closing := c.closing
+			c.closelock.Unlock()
+			cc := c.ChannelConfig(channel)
+			if closing || cc.MutedUntil == nil || !cc.MutedUntil.Equal(at) {
+				return
+			}
+			if err := c.Unmute(channel); err != nil {
+				c.Log.Println("unmute error:", err)
+				return
+			}
+			c.Log.Printf("no longer quiet in %s", channel)
+			c.Send(IRC{To: channel, Message: "\x01ACTION gasps for air\x01"})
+		})
+	})
+}
+
+// scheduleUnmutes starts unmute timers for channels muted for a while, such as before a restart
+func (c *Connection) scheduleUnmutes() {
+	for _, channel := range c.ConfiguredChannels() {
+		if cc := c.ChannelConfig(channel); cc.Muted != nil && *cc.Muted && cc.MutedUntil != nil {
+			c.unmuteAt(channel, cc.MutedUntil)
+		}
+	}
+}
+
+// ConfiguredChannels returns the channels with overrides
+func (c *Connection) ConfiguredChannels() []string {
+	var names []string
+	if c.boltdb == nil {
+		return nil
+	}
+	c.boltdb.View(func(tx *bolt.Tx) error {
+		bucket := c.bucket(tx, dbchannels)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names
+}
+
+// commandMasterChannel shows and changes channel settings:
+//
+//	channel                         list channels with settings
+//	channel #chan                   show settings, '*' marks the channel's own
+//	channel #chan karma off         set
+//	channel #chan karma default     back to the network's
+//
+// In a channel, the channel name can be left out.
+func commandMasterChannel(c *Connection, irc *IRC) {
+	args := irc.Arguments
+	channel := irc.To
+	if len(args) != 0 && c.IsChannel(args[0]) {
+		channel, args = args[0], args[1:]
+	}
+	if !c.IsChannel(channel) {
+		names := c.ConfiguredChannels()
+		if len(names) == 0 {
+			irc.Reply(c, "no channel settings")
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("channels with settings: %s", strings.Join(names, " ")))
+		return
+	}
+	cc := c.ChannelConfig(channel)
+	switch len(args) {
+	case 0, 1:
+		settings := c.Settings(channel)
+		var list []string
+		for _, name := range settingNames {
+			if len(args) == 1 && args[0] != name {
+				continue
+			}
+			mark := ""
+			if cc.isSet(name) {
+				mark = "*"
+			}
+			list = append(list, fmt.Sprintf("%s%s=%s", mark, name, settings.get(name)))
+		}
+		if len(list) == 0 {
+			irc.Reply(c, fmt.Sprintf("no setting %q, use one of %s", args[0], strings.Join(settingNames, ", ")))
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("%s: %s", channel, strings.Join(list, " ")))
+	default:
+		if err := cc.Set(args[0], strings.Join(args[1:], " ")); err != nil {
+			irc.Reply(c, err.Error())
+			return
+		}
+		if err := c.SetChannelConfig(channel, cc); err != nil {
+			c.Log.Println("channel config error:", err)
+			irc.Reply(c, "error saving channel settings, check logs")
+			return
+		}
+		irc.Reply(c, fmt.Sprintf("%s: %s=%s", channel, args[0], c.Settings(channel).get(args[0])))
+	}
+}
@@ -0,0 +1,89 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettings(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+
+	var cc ChannelConfig
+	for _, kv := range [][2]string{{"prefix", "."}, {"karma", "off"}, {"muted", "on"}, {"maxlines", "2"}} {
+		if err := cc.Set(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, kv := range [][2]string{{"karma", "maybe"}, {"maxlines", "-1"}, {"prefix", " "}, {"color", "on"}} {
+		if err := cc.Set(kv[0], kv[1]); err == nil {
+			t.Errorf("set %s %q: expected error", kv[0], kv[1])
+		}
+	}
+	if err := c.SetChannelConfig("#Chan", cc); err != nil {
+		t.Fatal(err)
+	}
+
+	// from the database, not the cache
+	c.chanconfigs = newChannelConfigs()
+	s := c.Settings("#chan")
+	if s.CommandPrefix != "." || s.Karma || !s.Muted || s.MaxLines != 2 || s.Define != c.config.Define {
+		t.Errorf("#chan: got %+v", s)
+	}
+	if s := c.Settings("#other"); s.CommandPrefix != "!" || s.Muted {
+		t.Errorf("#other: got %+v", s)
+	}
+	if s := c.Settings("someone"); s.CommandPrefix != "!" {
+		t.Errorf("private message: got %+v", s)
+	}
+	if names := c.ConfiguredChannels(); len(names) != 1 || names[0] != "#chan" {
+		t.Errorf("expected [#chan], got %q", names)
+	}
+
+	tc := c.conn.(*testconnection)
+	tc.buf.Reset()
+	c.Send(IRC{To: "#chan", Message: "hello"})
+	if tc.buf.Len() != 0 {
+		t.Errorf("muted: expected nothing sent, got %q", tc.buf.String())
+	}
+	cc.Set("muted", "default")
+	if err := c.SetChannelConfig("#chan", cc); err != nil {
+		t.Fatal(err)
+	}
+	c.Send(IRC{To: "#chan", Message: "one\ntwo\nthree"})
+	if got := strings.Count(tc.buf.String(), "PRIVMSG"); got != 2 {
+		t.Errorf("maxlines: expected 2 lines, got %q", tc.buf.String())
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	c, done := newDatabaseTestConnection(t)
+	defer done()
+
+	commandQuiet(c, Parse(":op!u@h PRIVMSG #chan :!quiet"))
+	if !c.Settings("#chan").Muted || c.Settings("#other").Muted {
+		t.Errorf("expected only #chan muted")
+	}
+	commandQuiet(c, Parse(":op!u@h PRIVMSG #chan :!quiet"))
+	if cc := c.ChannelConfig("#chan"); c.Settings("#chan").Muted || cc.Muted != nil {
+		t.Errorf("expected #chan unmuted without an override, got %+v", cc)
+	}
+	if len(c.ConfiguredChannels()) != 0 {
+		t.Errorf("expected no configured channels, got %q", c.ConfiguredChannels())
+	}
+	if err := c.Mute("#chan", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Settings("#chan").Muted {
+		t.Errorf("expected #chan muted for a while")
+	}
+	for deadline := time.Now().Add(5 * time.Second); c.ChannelConfig("#chan").Muted != nil; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected #chan unmuted after a while, got %+v", c.ChannelConfig("#chan"))
+		}
+	}
+	if c.Settings("#chan").Muted {
+		t.Errorf("expected #chan unmuted")
+	}
+}
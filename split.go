@@ -0,0 +1,121 @@
+package ircb
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// unknown hostmask, assume the longest we will probably see
+const (
+	maxUserLen = 10 // '~' and 9 characters
+	maxHostLen = 63
+)
+
+// lineBudget returns how many bytes of message fit in one line sent to target,
+// counting the ':nick!user@host VERB target :' prefix the server adds for others.
+func (c *Connection) lineBudget(verb, target string) int {
+	hostmask := c.Hostmask()
+	if hostmask == "" {
+		hostmask = c.config.Nick + "!" + strings.Repeat("u", maxUserLen) + "@" + strings.Repeat("h", maxHostLen)
+	}
+	// ':' hostmask ' ' verb ' ' target ' :' message '\r\n'
+	return c.ISupport().LineLen - len(":"+hostmask+" "+verb+" "+target+" :") - 2
+}
+
+// Hostmask returns the bot's own 'nick!user@host' as seen by others,
+// it is empty until the server shows it to us (usually when joining a channel).
+func (c *Connection) Hostmask() string {
+	c.hostlock.Lock()
+	defer c.hostlock.Unlock()
+	return c.hostmask
+}
+
+// learnHostmask from messages we send, that the server echoes back
+func (c *Connection) learnHostmask(irc *IRC) {
+	switch {
+	case irc.Nick == c.config.Nick && irc.User != "" && irc.Host != "":
+		c.hostlock.Lock()
+		c.hostmask = irc.Prefix
+		c.hostlock.Unlock()
+	case irc.Verb == "396" && len(irc.Params) > 1: // RPL_HOSTHIDDEN
+		c.hostlock.Lock()
+		if i := strings.IndexByte(c.hostmask, '@'); i != -1 {
+			c.hostmask = c.hostmask[:i+1] + irc.Params[1]
+		}
+		c.hostlock.Unlock()
+	}
+}
+
+// splitMessage splits s into lines no longer than max bytes.
+// It prefers to split between words, and never splits a UTF-8 sequence or color code.
+func splitMessage(s string, max int) []string {
+	if max < 16 {
+		max = 16
+	}
+	var lines []string
+	for len(s) > max {
+		cut := safeCut(s, max)
+		// prefer a word boundary, if it is not too far back
+		if i := strings.LastIndexByte(s[:cut+1], ' '); i > max/2 {
+			lines = append(lines, s[:i])
+			s = s[i+1:]
+			continue
+		}
+		lines = append(lines, s[:cut])
+		s = s[cut:]
+	}
+	// the tail
+	if s != "" {
+		lines = append(lines, s)
+	}
+	return lines
+}
+
+// safeCut returns the largest index <= max where s can be cut
+func safeCut(s string, max int) int {
+	cut := max
+	// back up to the start of a rune
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	// dont cut a color code such as '\x0304,12' or '\x04ff0000'
+	for j := cut - 1; j >= 0 && j >= cut-13; j-- {
+		if (s[j] == '\x03' || s[j] == '\x04') && formatEnd(s, j) > cut {
+			cut = j
+			break
+		}
+	}
+	if cut == 0 {
+		// nothing fits, should not happen with sane max
+		_, size := utf8.DecodeRuneInString(s)
+		return size
+	}
+	return cut
+}
+
+// formatEnd returns the index after the color code starting at s[i]
+func formatEnd(s string, i int) int {
+	digit := func(b byte) bool { return '0' <= b && b <= '9' }
+	hex := func(b byte) bool {
+		return digit(b) || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+	}
+	valid, n := digit, 2
+	if s[i] == '\x04' {
+		valid, n = hex, 6
+	}
+	k := i + 1
+	for m := 0; m < n && k < len(s) && valid(s[k]); m++ {
+		k++
+	}
+	if k == i+1 {
+		// just a reset
+		return k
+	}
+	if k+1 < len(s) && s[k] == ',' && valid(s[k+1]) {
+		k++
+		for m := 0; m < n && k < len(s) && valid(s[k]); m++ {
+			k++
+		}
+	}
+	return k
+}
@@ -0,0 +1,82 @@
+package ircb
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	testcases := []struct {
+		name  string
+		input string
+		max   int
+	}{
+		{"short", "hello world", 100},
+		{"ascii words", strings.Repeat("hello world ", 100), 100},
+		{"ascii no spaces", strings.Repeat("x", 1001), 100},
+		{"japanese", strings.Repeat("日本語のテキスト", 60), 100},
+		{"emoji", strings.Repeat("🙂", 200), 101},
+		{"mixed words", strings.Repeat("héllo wörld 日本 ", 80), 97},
+		{"colors", strings.Repeat("\x0304,12red\x03 \x02bold\x02 ", 80), 50},
+		{"hex colors", strings.Repeat("\x04ff0000,00ff00x", 80), 50},
+	}
+	for _, test := range testcases {
+		lines := splitMessage(test.input, test.max)
+		if len(lines) == 0 {
+			t.Errorf("%s: no lines", test.name)
+			continue
+		}
+		var total int
+		for i, line := range lines {
+			total += len(line)
+			if len(line) > test.max {
+				t.Errorf("%s: line %d is %d bytes, max %d", test.name, i, len(line), test.max)
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("%s: line %d is not valid utf8: %q", test.name, i, line)
+			}
+			// line must not end in the middle of a color code
+			if j := strings.LastIndexAny(line, "\x03\x04"); j != -1 && i < len(lines)-1 {
+				if end := formatEnd(line+lines[i+1], j); end > len(line) {
+					t.Errorf("%s: line %d cuts color code: %q", test.name, i, line[j:])
+				}
+			}
+		}
+		// nothing lost, except spaces between words
+		if total < len(test.input)-len(lines)+1 {
+			t.Errorf("%s: lost %d bytes", test.name, len(test.input)-total)
+		}
+		if strings.Replace(strings.Join(lines, ""), " ", "", -1) != strings.Replace(test.input, " ", "", -1) {
+			t.Errorf("%s: lines do not add up to input", test.name)
+		}
+	}
+}
+
+func TestSplitMessageWords(t *testing.T) {
+	lines := splitMessage("the quick brown fox jumps over the lazy dog", 20)
+	want := []string{"the quick brown fox", "jumps over the lazy", "dog"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("wanted %q, got %q", want, lines)
+	}
+}
+
+func TestSendSplit(t *testing.T) {
+	c := NewTestConnection()
+	c.hostmask = "testing!~testing@example.com"
+	long := strings.Repeat("ü", 600) + " tail"
+	c.Send(IRC{To: "#ok", Message: long})
+	out := c.conn.(*testconnection).buf.String()
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	if len(lines) != 3 {
+		t.Fatalf("wanted 3 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if n := len(":" + c.hostmask + " " + line + "\r\n"); n > 512 {
+			t.Errorf("line would be %d bytes", n)
+		}
+	}
+	if !strings.HasSuffix(lines[2], " tail") && !strings.HasSuffix(lines[2], ":tail") {
+		t.Errorf("tail was lost: %q", lines[2])
+	}
+}
@@ -20,8 +20,13 @@ const (
 )
 
 // Respawn closes connections after executing self, can be called at any time.
+// When running in a Bot, all networks are closed.
 func (c *Connection) Respawn() {
 	spawn.Spawn()
+	if c.bot != nil {
+		c.bot.Close()
+		return
+	}
 	c.Close()
 }
 
@@ -43,8 +48,13 @@ var LoadPlugin = func(c *Connection, s string) error {
 	return ErrNoPluginSupport
 }
 
-func openlogfile() (f *os.File, err error) {
-	return os.OpenFile(".log.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+// openlogfile opens .log.txt, or .log.network.txt if network is not empty
+func openlogfile(network string) (f *os.File, err error) {
+	name := ".log.txt"
+	if network != "" {
+		name = ".log." + network + ".txt"
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 }
 
 var dbkarma = []byte("karma")
@@ -64,19 +74,7 @@ func loadDatabase(filename string) (*bolt.DB, error) {
 
 	defer tx.Rollback()
 
-	// make karma bucket
-	_, err = tx.CreateBucketIfNotExists(dbkarma)
-	if err != nil {
-		return nil, err
-	}
-	// make dictionary bucket
-	_, err = tx.CreateBucketIfNotExists(dbdef)
-	if err != nil {
-		return nil, err
-	}
-	// make history bucket
-	_, err = tx.CreateBucketIfNotExists(dbhistory)
-	if err != nil {
+	if err = createBuckets(tx); err != nil {
 		return nil, err
 	}
 
@@ -87,6 +85,22 @@ func loadDatabase(filename string) (*bolt.DB, error) {
 
 	return db, nil
 }
+
+// bucketCreator is a *bolt.Tx or a *bolt.Bucket
+type bucketCreator interface {
+	CreateBucketIfNotExists(name []byte) (*bolt.Bucket, error)
+}
+
+// createBuckets makes the karma (global and per channel), karma log and alias, dictionary, factoids, history, roles and channels buckets if not exist
+func createBuckets(parent bucketCreator) error {
+	for _, name := range [][]byte{dbkarma, dbdef, dbhistory, dbroles, dbcommandroles, dbchannels, dbkarmalog, dbkarmaalias, dbkarmachan, dbfactoids} {
+		if _, err := parent.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Connection) getDefinition(word string) (definition string) {
 	tx, err := c.boltdb.Begin(false)
 	if err != nil {
@@ -95,68 +109,22 @@ func (c *Connection) getDefinition(word string) (definition string) {
 	}
 
 	defer tx.Rollback()
-	bucket := tx.Bucket(dbdef)
+	bucket := c.bucket(tx, dbdef)
 	val := bucket.Get([]byte(word))
 	return string(val)
 }
-func (c *Connection) databaseDefine(word, definition string) error {
-	tx, err := c.boltdb.Begin(true)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	bucket := tx.Bucket(dbdef)
-	if err != nil {
-		return err
-	}
-
-	if err := bucket.Put([]byte(word), []byte(definition)); err != nil {
-		return err
-	}
-
-	return tx.Commit()
-
-}
-func (c *Connection) karmaDown(name string) error {
-	err := c.boltdb.Update(func(tx *bolt.Tx) error {
-		defer tx.Rollback()
-		bucket := tx.Bucket(dbkarma)
-		current := bytes2int(bucket.Get([]byte(name)))
-		if err := bucket.Put([]byte(name), int2bytes(current-1)); err != nil {
-			return err
-		}
-
-		return nil
-	})
-	return err
-}
 
-func (c *Connection) karmaUp(name string) error {
-	err := c.boltdb.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(dbkarma)
-		current := bytes2int(bucket.Get([]byte(name)))
-		if err := bucket.Put([]byte(name), int2bytes(current+1)); err != nil {
-			return err
-		}
-
-		return nil
-	})
-	if err != nil {
-		println(err)
-	}
-	//	return err
-	return nil
-}
-
-func (c *Connection) karmaShow(name string) string {
-	var current string
+// karmaShow returns name's karma on the channel's scoreboard, see karmaBoard
+func (c *Connection) karmaShow(channel, name string) string {
+	current := "0"
+	// before the tx, KarmaName and karmaBoard read the database in their own
+	key, board := []byte(c.KarmaName(name)), c.karmaBoard(channel)
 	err := c.boltdb.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(dbkarma)
+		bucket, err := c.karmaBucket(tx, board)
 		if bucket == nil {
-			return fmt.Errorf("nil bucket")
+			return err
 		}
-		current = strconv.Itoa(bytes2int(bucket.Get([]byte(name))))
-
+		current = strconv.Itoa(bytes2int(bucket.Get(key)))
 		return nil
 	})
 	if err != nil {